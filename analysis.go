@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const emailAnalysisSchemaFile = "email_analysis.schema.json"
+
+// The structured result of analyzing an email, as returned by the model.
+type EmailAnalysis struct {
+	Summary     string       `json:"summary"`
+	ActionItems []ActionItem `json:"action_items"`
+	Category    string       `json:"category"`
+	Categories  []string     `json:"categories"`
+	NeedsReply  bool         `json:"needs_reply"`
+	KeyDates    []KeyDate    `json:"key_dates"`
+	// Nil when the template does not ask for them
+	People        []string `json:"people"`
+	Organizations []string `json:"organizations"`
+	// From 1 to 5, or 0 when the template does not ask for it
+	Urgency       int    `json:"urgency,omitempty"`
+	UrgencyReason string `json:"urgency_reason,omitempty"`
+}
+
+type ActionItem struct {
+	Task string `json:"task"`
+	// YYYY-MM-DD, or "" when the email gives no due date
+	Due string `json:"due"`
+}
+
+type KeyDate struct {
+	Date        string `json:"date"`
+	Description string `json:"description"`
+}
+
+var (
+	emailAnalysisSchema     *JSONSchema
+	emailAnalysisSchemaOnce sync.Once
+)
+
+func getEmailAnalysisSchema() *JSONSchema {
+	emailAnalysisSchemaOnce.Do(func() {
+		schema, err := loadJSONSchema(emailAnalysisSchemaFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		emailAnalysisSchema = schema
+	})
+	return emailAnalysisSchema
+}
+
+// Parse and validate the model's analysis of an email.
+func parseAnalysis(completion string) (EmailAnalysis, error) {
+	var analysis EmailAnalysis
+	if err := decodeValidated(completion, getEmailAnalysisSchema(), &analysis); err != nil {
+		return EmailAnalysis{}, err
+	}
+
+	analysis.Summary = strings.TrimSpace(analysis.Summary)
+	analysis.Category = strings.TrimSpace(analysis.Category)
+	analysis.UrgencyReason = strings.TrimSpace(analysis.UrgencyReason)
+	analysis.ActionItems = dedupeActionItems([][]ActionItem{analysis.ActionItems})
+	analysis.KeyDates = dedupeKeyDates([][]KeyDate{analysis.KeyDates})
+	return analysis, nil
+}
+
+// Merge the action items extracted from each chunk, keeping the first occurrence of
+// each and the first due date given for it.
+func dedupeActionItems(lists [][]ActionItem) []ActionItem {
+	var merged []ActionItem
+	index := make(map[string]int)
+	for _, list := range lists {
+		for _, item := range list {
+			item.Task = strings.TrimSpace(item.Task)
+			key := normalizeActionItem(item.Task)
+			if key == "" {
+				continue
+			}
+			if i, ok := index[key]; ok {
+				if merged[i].Due == "" {
+					merged[i].Due = item.Due
+				}
+				continue
+			}
+			index[key] = len(merged)
+			merged = append(merged, item)
+		}
+	}
+	return merged
+}
+
+func dedupeKeyDates(lists [][]KeyDate) []KeyDate {
+	var merged []KeyDate
+	seen := make(map[string]bool)
+	for _, list := range lists {
+		for _, keyDate := range list {
+			key := keyDate.Date + " " + normalizeActionItem(keyDate.Description)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			merged = append(merged, keyDate)
+		}
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].Date < merged[j].Date
+	})
+	return merged
+}
+
+// Combine the analyses of each chunk without the model, used when the merge
+// response cannot be parsed.
+func mergeAnalyses(analyses []EmailAnalysis) EmailAnalysis {
+	var merged EmailAnalysis
+	var summaries []string
+	var actionItems [][]ActionItem
+	var keyDates [][]KeyDate
+	for _, analysis := range analyses {
+		if analysis.Summary != "" {
+			summaries = append(summaries, analysis.Summary)
+		}
+		if merged.Category == "" {
+			merged.Category = analysis.Category
+		}
+		merged.Categories = append(merged.Categories, analysis.Categories...)
+		merged.NeedsReply = merged.NeedsReply || analysis.NeedsReply
+		if analysis.People != nil || analysis.Organizations != nil {
+			merged.People = append(nonNil(merged.People), analysis.People...)
+			merged.Organizations = append(nonNil(merged.Organizations), analysis.Organizations...)
+		}
+		if analysis.Urgency > merged.Urgency {
+			merged.Urgency, merged.UrgencyReason = analysis.Urgency, analysis.UrgencyReason
+		}
+		actionItems = append(actionItems, analysis.ActionItems)
+		keyDates = append(keyDates, analysis.KeyDates)
+	}
+	merged.Summary = strings.Join(summaries, " ")
+	merged.ActionItems = dedupeActionItems(actionItems)
+	merged.KeyDates = dedupeKeyDates(keyDates)
+	return merged
+}
+
+// An empty slice in place of nil, so lists the model gave stay distinguishable
+// from lists it was not asked for.
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
+
+// Format action items as a numbered list, stating explicitly when there are none.
+func formatActionItems(items []ActionItem) string {
+	if len(items) == 0 {
+		return "No action items"
+	}
+
+	var sb strings.Builder
+	for i, item := range items {
+		sb.WriteString(fmt.Sprintf("%d. %s", i+1, item.Task))
+		if item.Due != "" {
+			sb.WriteString(" (due " + item.Due + ")")
+		}
+		sb.WriteString("\n")
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+// Parse the numbered list written by formatActionItems back into action items.
+func parseActionItemsText(text string) []ActionItem {
+	var items []ActionItem
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line == "No action items" {
+			continue
+		}
+		if number, rest, ok := strings.Cut(line, ". "); ok && strings.Trim(number, "0123456789") == "" {
+			line = rest
+		}
+
+		item := ActionItem{Task: line}
+		if i := strings.LastIndex(line, " (due "); i != -1 && strings.HasSuffix(line, ")") {
+			item.Task = line[:i]
+			item.Due = line[i+len(" (due ") : len(line)-1]
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+func formatKeyDates(keyDates []KeyDate) string {
+	lines := make([]string, len(keyDates))
+	for i, keyDate := range keyDates {
+		lines[i] = keyDate.Date + ": " + keyDate.Description
+	}
+	return strings.Join(lines, "\n")
+}
+
+// The earliest due date of the action items, or "" if none have one.
+func earliestDue(items []ActionItem) string {
+	earliest := ""
+	for _, item := range items {
+		if item.Due != "" && (earliest == "" || item.Due < earliest) {
+			earliest = item.Due
+		}
+	}
+	return earliest
+}
+
+// The analyses of each chunk as JSON for the merge prompt.
+func formatAnalysesForPrompt(analyses []EmailAnalysis) string {
+	data, err := json.MarshalIndent(analyses, "", "  ")
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
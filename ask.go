@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultAskSources = 5
+
+var citationRegex = regexp.MustCompile(`\[(\d+)\]`)
+
+// Phrases naming when emails came, matched as whole words. Followed by 's they
+// name something else, as in "today's deadline".
+var dateRangeRegex = regexp.MustCompile(`(?i)\b(today|yesterday|last week|this week|last month|this month)\b('s|’s)?`)
+
+// Which indexed emails a question may be answered from.
+type AskFilter struct {
+	From  string
+	Since string
+	Until string
+}
+
+func (f AskFilter) keep(entry IndexEntry) bool {
+	if f.From != "" {
+		from := strings.ToLower(f.From)
+		if !strings.Contains(strings.ToLower(entry.From), from) && !strings.Contains(strings.ToLower(entry.SenderEmail), from) {
+			return false
+		}
+	}
+	day := entry.Date
+	if len(day) >= len("2006-01-02") {
+		day = day[:len("2006-01-02")]
+	}
+	if f.Since != "" && day < f.Since {
+		return false
+	}
+	if f.Until != "" && day > f.Until {
+		return false
+	}
+	return true
+}
+
+// The date range a question refers to with phrases like "this month", relative
+// to now in the user's timezone. The first phrase counts. Empty when it names none.
+func questionDateRange(question string, now time.Time) (string, string) {
+	now = now.In(userLocation())
+	day := func(t time.Time) string { return t.Format("2006-01-02") }
+	weekStart := now.AddDate(0, 0, -int((now.Weekday()+6)%7))
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+
+	for _, match := range dateRangeRegex.FindAllStringSubmatch(question, -1) {
+		if match[2] != "" {
+			continue
+		}
+		switch strings.ToLower(match[1]) {
+		case "today":
+			return day(now), day(now)
+		case "yesterday":
+			return day(now.AddDate(0, 0, -1)), day(now.AddDate(0, 0, -1))
+		case "last week":
+			return day(weekStart.AddDate(0, 0, -7)), day(weekStart.AddDate(0, 0, -1))
+		case "this week":
+			return day(weekStart), day(now)
+		case "last month":
+			return day(monthStart.AddDate(0, -1, 0)), day(monthStart.AddDate(0, 0, -1))
+		case "this month":
+			return day(monthStart), day(now)
+		}
+	}
+	return "", ""
+}
+
+// The retrieved emails as numbered sources for the ask prompt, each cut so they
+// all fit the chunk token budget.
+func formatSourcesForPrompt(results []SearchResult) string {
+	chunkTokens, _, _ := chunkSettings()
+	perSource := chunkTokens / max(len(results), 1)
+
+	var sb strings.Builder
+	for i, result := range results {
+		entry := result.Entry
+		fmt.Fprintf(&sb, "[%d] Date: %s\nFrom: %s\nSubject: %s\nSummary: %s\n", i+1, entry.Date, entry.From, entry.Subject, entry.Summary)
+		if len(entry.ActionItems) > 0 {
+			sb.WriteString("Action items: " + strings.Join(entry.ActionItems, "; ") + "\n")
+		}
+		text := entry.Text
+		if countTokens(text) > perSource {
+			text = splitByTokens(text, perSource)[0]
+		}
+		sb.WriteString("Text:\n" + text + "\n\n")
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+func generateAskPrompt(question string, results []SearchResult) RenderedPrompt {
+	data := userPromptData()
+	data["Question"] = question
+	data["Today"] = time.Now().In(userLocation()).Format("2006-01-02")
+	data["Emails"] = formatSourcesForPrompt(results)
+	return renderPrompt("ask", data)
+}
+
+// The source numbers cited in an answer, in the order they first appear.
+func citedSources(answer string, count int) []int {
+	var cited []int
+	seen := make(map[int]bool)
+	for _, match := range citationRegex.FindAllStringSubmatch(answer, -1) {
+		n, err := strconv.Atoi(match[1])
+		if err != nil || n < 1 || n > count || seen[n] {
+			continue
+		}
+		seen[n] = true
+		cited = append(cited, n)
+	}
+	return cited
+}
+
+// Answer a question from the indexed emails most similar to it, citing the
+// emails the answer is based on.
+func askInbox(question string, limit int, filter AskFilter) {
+	index, err := readSearchIndex()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(index.Entries) == 0 {
+		fmt.Println("The search index is empty. Set searchIndex in settings.json and run jot to add emails to it.")
+		return
+	}
+
+	if filter.Since == "" && filter.Until == "" {
+		filter.Since, filter.Until = questionDateRange(question, time.Now())
+		if filter.Since != "" {
+			fmt.Printf("Searching emails from %s to %s, use -since and -until to change this.\n\n", filter.Since, filter.Until)
+		}
+	}
+
+	vector, err := embedText(question, true)
+	if err != nil {
+		log.Fatalf("Unable to embed the question: %v", err)
+	}
+	results, _ := index.search(vector, limit, filter.keep)
+	if len(results) == 0 {
+		fmt.Println("No emails match the question's filters.")
+		return
+	}
+
+	prompt := generateAskPrompt(question, results)
+	answer, _, err := callLLM(prompt)
+	if err != nil {
+		log.Fatalf("Unable to answer the question: %v", err)
+	}
+	fmt.Println(answer)
+
+	cited := citedSources(answer, len(results))
+	if len(cited) == 0 {
+		fmt.Println("\nNo sources cited.")
+		return
+	}
+	fmt.Println("\nSources:")
+	for _, n := range cited {
+		entry := results[n-1].Entry
+		fmt.Printf("[%d] %s  %s  %s\n", n, entry.Date, entry.From, entry.Subject)
+		if entry.Link != "" {
+			fmt.Printf("    Gmail:  %s\n", entry.Link)
+		}
+		if entry.NotionURL != "" {
+			fmt.Printf("    Notion: %s\n", entry.NotionURL)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuestionDateRange(t *testing.T) {
+	setConfiguration(Configuration{Timezone: "UTC"})
+	// A Wednesday
+	now := time.Date(2024, 5, 15, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		question     string
+		since, until string
+	}{
+		{"What did Ann send today?", "2024-05-15", "2024-05-15"},
+		{"Anything from yesterday about the launch?", "2024-05-14", "2024-05-14"},
+		{"Which invoices came in this week?", "2024-05-13", "2024-05-15"},
+		{"Who wrote to me last week", "2024-05-06", "2024-05-12"},
+		{"What was due THIS MONTH?", "2024-05-01", "2024-05-15"},
+		{"Summarize last month", "2024-04-01", "2024-04-30"},
+		{"What is today's deadline?", "", ""},
+		{"What did we agree for this month’s budget?", "", ""},
+		{"Plans for this weekend?", "", ""},
+		{"Who asked about the todays list?", "", ""},
+		{"When is the launch?", "", ""},
+		// The first phrase that names a range counts
+		{"Is today's deadline still the one from last week?", "2024-05-06", "2024-05-12"},
+	}
+	for _, tt := range tests {
+		since, until := questionDateRange(tt.question, now)
+		if since != tt.since || until != tt.until {
+			t.Errorf("questionDateRange(%q) = %q, %q, want %q, %q", tt.question, since, until, tt.since, tt.until)
+		}
+	}
+}
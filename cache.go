@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	cacheDirName = ".jot-cache"
+
+	defaultCacheTTL        = 30 * 24 * time.Hour
+	defaultCacheMaxEntries = 5000
+	defaultCacheMaxBytes   = 50 << 20
+)
+
+// Set by --no-cache. Cached results are ignored, but fresh ones are still saved.
+var cacheDisabled bool
+
+// A parsed LLM result saved in the cache.
+type cacheEntry struct {
+	Created  time.Time       `json:"created"`
+	Template string          `json:"template"`
+	Model    string          `json:"model"`
+	Result   json.RawMessage `json:"result"`
+}
+
+// The cache key of a prompt: its template and version, the backend that answers it
+// and the rendered prompt, which holds the cleaned email text.
+func cacheKey(prompt RenderedPrompt, backend LLMBackend) string {
+	hash := sha256.New()
+	for _, part := range []string{prompt.Name, prompt.Version, backend.name(), prompt.Text} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func cacheTTL() time.Duration {
+	ttl := getConfiguration().CacheTTL
+	if ttl == "" {
+		return defaultCacheTTL
+	}
+	duration, err := time.ParseDuration(ttl)
+	if err != nil {
+		fmt.Printf("Invalid cacheTTL %q, using %v: %v\n", ttl, defaultCacheTTL, err)
+		return defaultCacheTTL
+	}
+	return duration
+}
+
+// Read a cached result into target. Returns false on a miss or an expired entry.
+func readCache(key string, target any) bool {
+	if cacheDisabled {
+		return false
+	}
+
+	path := filepath.Join(cacheDirName, key+".json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		os.Remove(path)
+		return false
+	}
+	if time.Since(entry.Created) > cacheTTL() {
+		os.Remove(path)
+		return false
+	}
+	return json.Unmarshal(entry.Result, target) == nil
+}
+
+func writeCache(key string, prompt RenderedPrompt, model string, result any) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	entry, err := json.Marshal(cacheEntry{
+		Created:  time.Now(),
+		Template: prompt.Name + "/" + prompt.Version,
+		Model:    model,
+		Result:   data,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(cacheDirName, 0700); err != nil {
+		return err
+	}
+	// Write to a temporary file first so a concurrent reader never sees half an entry
+	tmp, err := os.CreateTemp(cacheDirName, key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(entry); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(cacheDirName, key+".json"))
+}
+
+// Call the model with a prompt and parse its answer, reusing the parsed result of an
+// earlier call with the same template version, model and email text. Answers that
+// fail to parse are not cached.
+func completeJSON[T any](prompt RenderedPrompt, parse func(string) (T, error)) (T, error) {
+	result, _, err := completeJSONWithModel(prompt, parse)
+	return result, err
+}
+
+// Like completeJSON, also returning the model that produced the result. Answers
+// that fail to parse are passed down the fallback chain. Each backend has its own
+// cache entries, so an answer from a fallback is only reused when the backends
+// before it fail again.
+func completeJSONWithModel[T any](prompt RenderedPrompt, parse func(string) (T, error)) (T, string, error) {
+	var result T
+	model, err := withFallback(prompt, func(backend LLMBackend) error {
+		key := cacheKey(prompt, backend)
+		if readCache(key, &result) {
+			return nil
+		}
+		answer, err := complete(backend, prompt)
+		if err != nil {
+			return err
+		}
+		if result, err = parse(answer); err != nil {
+			return err
+		}
+		if err := writeCache(key, prompt, backend.name(), result); err != nil {
+			fmt.Println("Unable to cache LLM result: ", err)
+		}
+		return nil
+	})
+	return result, model, err
+}
+
+// Remove expired entries, then the oldest ones until the cache is within the
+// configured number of entries and size.
+func pruneCache() error {
+	entries, err := os.ReadDir(cacheDirName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	config := getConfiguration()
+	maxEntries := config.CacheMaxEntries
+	if maxEntries <= 0 {
+		maxEntries = defaultCacheMaxEntries
+	}
+	maxBytes := config.CacheMaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultCacheMaxBytes
+	}
+	ttl := cacheTTL()
+
+	type cacheFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var files []cacheFile
+	var totalBytes int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(cacheDirName, entry.Name())
+		// Expired entries and temporary files left behind by an interrupted write
+		if time.Since(info.ModTime()) > ttl || strings.HasSuffix(entry.Name(), ".tmp") {
+			os.Remove(path)
+			continue
+		}
+		files = append(files, cacheFile{path, info.Size(), info.ModTime()})
+		totalBytes += info.Size()
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	for len(files) > 0 && (len(files) > maxEntries || totalBytes > maxBytes) {
+		if err := os.Remove(files[0].path); err != nil {
+			return err
+		}
+		totalBytes -= files[0].size
+		files = files[1:]
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A user-defined email category. Emails are put in it when they match one of its
+// keywords or senders, or when the LLM picks it based on the description.
+type Category struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Keywords    []string `json:"keywords"`
+	// Full addresses or domains written as "@example.com"
+	Senders []string `json:"senders"`
+	// Notion option color, e.g. "blue"
+	Color string `json:"color"`
+}
+
+// Whether the sender matches one of the patterns, either a full address or a
+// domain written as "@example.com".
+func matchesSender(sender *mail.Address, patterns []string) bool {
+	if sender == nil {
+		return false
+	}
+	address := strings.ToLower(sender.Address)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+		if address == pattern || (strings.HasPrefix(pattern, "@") && strings.HasSuffix(address, pattern)) {
+			return true
+		}
+	}
+	return false
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// A pattern for a keyword as a whole word. Unlike \b, the boundary is only required
+// at ends of the keyword that are letters or digits, so "C++" and ".net" match
+// too, and letters outside ASCII count as part of words.
+func keywordPattern(keyword string) string {
+	pattern := regexp.QuoteMeta(keyword)
+	if first, _ := utf8.DecodeRuneInString(keyword); isWordRune(first) {
+		pattern = `(?:^|[^\pL\pN_])` + pattern
+	}
+	if last, _ := utf8.DecodeLastRuneInString(keyword); isWordRune(last) {
+		pattern += `(?:[^\pL\pN_]|$)`
+	}
+	return pattern
+}
+
+// Keyword lists compiled into a single regex each, nil when a list is empty.
+// Cleared with the settings.
+var (
+	keywordRegexes   = make(map[string]*regexp.Regexp)
+	keywordRegexesMu sync.Mutex
+)
+
+func keywordRegex(keywords []string) *regexp.Regexp {
+	key := strings.Join(keywords, "\x00")
+	keywordRegexesMu.Lock()
+	defer keywordRegexesMu.Unlock()
+	if re, ok := keywordRegexes[key]; ok {
+		return re
+	}
+
+	var patterns []string
+	for _, keyword := range keywords {
+		if keyword = strings.TrimSpace(keyword); keyword != "" {
+			patterns = append(patterns, keywordPattern(keyword))
+		}
+	}
+	var re *regexp.Regexp
+	if len(patterns) > 0 {
+		re = regexp.MustCompile(`(?i)` + strings.Join(patterns, "|"))
+	}
+	keywordRegexes[key] = re
+	return re
+}
+
+func resetKeywordRegexes() {
+	keywordRegexesMu.Lock()
+	keywordRegexes = make(map[string]*regexp.Regexp)
+	keywordRegexesMu.Unlock()
+}
+
+func matchesKeyword(text string, keywords []string) bool {
+	re := keywordRegex(keywords)
+	return re != nil && re.MatchString(text)
+}
+
+// The configured categories listed for the prompt, one per line.
+func formatCategoriesForPrompt(categories []Category) string {
+	var lines []string
+	for _, category := range categories {
+		line := "  - " + category.Name
+		if category.Description != "" {
+			line += ": " + category.Description
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Notion multi-select options for the configured categories.
+func categoryOptions() []SelectOption {
+	var options []SelectOption
+	for _, category := range getConfiguration().Categories {
+		options = append(options, SelectOption{Name: category.Name, Color: category.Color})
+	}
+	return options
+}
+
+// Pick the categories for an email. Keyword and sender rules are applied first,
+// then the categories the LLM chose are added. With no categories configured the
+// LLM's own categories are used as they are.
+func categorize(email Email, analysis EmailAnalysis) []string {
+	llmCategories := analysis.Categories
+	if analysis.Category != "" {
+		llmCategories = append(llmCategories, analysis.Category)
+	}
+
+	configured := getConfiguration().Categories
+	var categories []string
+	seen := make(map[string]bool)
+	add := func(name string) {
+		// Notion rejects option names containing commas
+		name = strings.TrimSpace(strings.ReplaceAll(name, ",", ""))
+		key := strings.ToLower(name)
+		if name == "" || seen[key] {
+			return
+		}
+		seen[key] = true
+		categories = append(categories, name)
+	}
+
+	if len(configured) == 0 {
+		for _, name := range llmCategories {
+			add(name)
+		}
+		return categories
+	}
+
+	text := email.subject + "\n" + strings.Join(email.body, "\n")
+	byName := make(map[string]string)
+	for _, category := range configured {
+		byName[strings.ToLower(category.Name)] = category.Name
+		if matchesSender(email.sender, category.Senders) || matchesKeyword(text, category.Keywords) {
+			add(category.Name)
+		}
+	}
+
+	for _, name := range llmCategories {
+		canonical, ok := byName[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			fmt.Printf("Ignoring unknown category %q from the LLM\n", name)
+			continue
+		}
+		add(canonical)
+	}
+	return categories
+}
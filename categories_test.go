@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestMatchesKeyword(t *testing.T) {
+	setConfiguration(Configuration{})
+
+	tests := []struct {
+		name     string
+		text     string
+		keywords []string
+		want     bool
+	}{
+		{"whole word", "Your invoice is attached", []string{"invoice"}, true},
+		{"ignores case", "INVOICE attached", []string{"invoice"}, true},
+		{"part of a word", "Your invoices are attached", []string{"invoice"}, false},
+		{"any keyword", "The budget for Q3", []string{"invoice", "budget"}, true},
+		{"blank keyword", "anything", []string{" ", ""}, false},
+		{"no keywords", "anything", nil, false},
+		{"trailing symbols", "Looking for C++ developers", []string{"C++"}, true},
+		{"trailing symbols at the end", "We use C++", []string{"C++"}, true},
+		{"trailing symbols after punctuation", "Skills: Go, C++.", []string{"C++"}, true},
+		{"trailing symbols inside a word", "We use ObjC++ here", []string{"C++"}, false},
+		{"leading symbol", "Port it to .NET soon", []string{".net"}, true},
+		{"leading symbol after a word", "Built with ASP.NET", []string{".net"}, true},
+		{"leading symbol before a word", "Join the .network", []string{".net"}, false},
+		{"non-ASCII letters", "Café opening", []string{"caf"}, false},
+		{"non-ASCII keyword", "Rechnung für März", []string{"märz"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchesKeyword(tt.text, tt.keywords); got != tt.want {
+				t.Errorf("matchesKeyword(%q, %q) = %v, want %v", tt.text, tt.keywords, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/pkoukk/tiktoken-go"
+)
+
+const (
+	// Mistral has no tiktoken encoding, cl100k_base gives a close enough count for budgeting
+	tokenEncodingName = "cl100k_base"
+	// Used when the encoding cannot be loaded, e.g. offline on the first run
+	charsPerToken = 4
+
+	defaultChunkTokens   = 1500
+	defaultChunkOverlap  = 150
+	defaultMaxChunkCount = 8
+)
+
+var (
+	tokenEncoding     *tiktoken.Tiktoken
+	tokenEncodingOnce sync.Once
+)
+
+func getTokenEncoding() *tiktoken.Tiktoken {
+	tokenEncodingOnce.Do(func() {
+		encoding, err := tiktoken.GetEncoding(tokenEncodingName)
+		if err != nil {
+			fmt.Println("Unable to load token encoding, approximating token counts: ", err)
+			return
+		}
+		tokenEncoding = encoding
+	})
+	return tokenEncoding
+}
+
+// Count the tokens in text, approximating when no encoding is available.
+func countTokens(text string) int {
+	if encoding := getTokenEncoding(); encoding != nil {
+		return len(encoding.Encode(text, nil, nil))
+	}
+	return (len([]rune(text)) + charsPerToken - 1) / charsPerToken
+}
+
+// Split text that is over the budget on its own into pieces of at most maxTokens.
+func splitByTokens(text string, maxTokens int) []string {
+	var pieces []string
+	if encoding := getTokenEncoding(); encoding != nil {
+		tokens := encoding.Encode(text, nil, nil)
+		for start := 0; start < len(tokens); start += maxTokens {
+			end := min(start+maxTokens, len(tokens))
+			pieces = append(pieces, encoding.Decode(tokens[start:end]))
+		}
+		return pieces
+	}
+
+	runes := []rune(text)
+	step := maxTokens * charsPerToken
+	for start := 0; start < len(runes); start += step {
+		end := min(start+step, len(runes))
+		pieces = append(pieces, string(runes[start:end]))
+	}
+	return pieces
+}
+
+// Pack the text portions of an email body into chunks of at most maxTokens.
+// Each chunk after the first starts with the trailing portions of the previous
+// one, up to overlapTokens, so action items spanning a boundary are not lost.
+func splitIntoChunks(portions []string, maxTokens, overlapTokens int) []string {
+	type portion struct {
+		text   string
+		tokens int
+	}
+
+	var pieces []portion
+	for _, text := range portions {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		tokens := countTokens(text)
+		if tokens <= maxTokens {
+			pieces = append(pieces, portion{text, tokens})
+			continue
+		}
+		for _, piece := range splitByTokens(text, maxTokens) {
+			pieces = append(pieces, portion{piece, countTokens(piece)})
+		}
+	}
+
+	var chunks []string
+	var current []portion
+	currentTokens := 0
+	// Portions in current that have not been part of an emitted chunk yet
+	fresh := 0
+
+	flush := func() {
+		texts := make([]string, len(current))
+		for i, p := range current {
+			texts[i] = p.text
+		}
+		chunks = append(chunks, strings.Join(texts, "\n"))
+
+		// Carry the tail of this chunk over into the next one
+		var overlap []portion
+		overlapSize := 0
+		for i := len(current) - 1; i >= 0; i-- {
+			if overlapSize+current[i].tokens > overlapTokens {
+				break
+			}
+			overlap = append([]portion{current[i]}, overlap...)
+			overlapSize += current[i].tokens
+		}
+		current = overlap
+		currentTokens = overlapSize
+		fresh = 0
+	}
+
+	for _, p := range pieces {
+		if currentTokens+p.tokens > maxTokens && len(current) > 0 {
+			flush()
+			// Drop the overlap if it leaves no room for the new portion
+			for len(current) > 0 && currentTokens+p.tokens > maxTokens {
+				currentTokens -= current[0].tokens
+				current = current[1:]
+			}
+		}
+		current = append(current, p)
+		currentTokens += p.tokens
+		fresh++
+	}
+	if fresh > 0 {
+		flush()
+	}
+
+	return chunks
+}
+
+// Normalise an action item for comparison so that trivially different wordings of
+// the same item from overlapping chunks are treated as duplicates.
+func normalizeActionItem(item string) string {
+	fields := strings.FieldsFunc(strings.ToLower(item), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	return strings.Join(fields, " ")
+}
+
+// The header followed by the first chunk of the body, for prompts that only need
+// the start of an email.
+func firstChunk(header string, body []string) string {
+	chunkTokens, overlapTokens, _ := chunkSettings()
+	chunks := splitIntoChunks(body, chunkTokens, overlapTokens)
+	if len(chunks) == 0 {
+		return header
+	}
+	return header + "\n" + chunks[0]
+}
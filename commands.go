@@ -0,0 +1,224 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, `Usage:
+  jot [--no-cache]                            fetch new email, summarize it and update Notion
+  jot prompt render [-template name] file.eml preview the prompt sent to the model for an email
+  jot digest [-date YYYY-MM-DD]               write the digest page for a day, today by default
+  jot report weekly [-end YYYY-MM-DD] [-markdown file.md]
+                                              write the report for the week ending on a day, today by default
+  jot eval [-config a.json] [-compare b.json] [-threshold 0.5] dir
+                                              score action item extraction against labeled .eml files
+  jot search [-n 10] "query"                  find processed emails by meaning
+  jot ask [-n 5] [-from sender] [-since YYYY-MM-DD] [-until YYYY-MM-DD] "question"
+                                              answer a question from processed emails, with sources
+  jot feedback sync                           learn from rows corrected in Notion
+  jot usage [-days 7] [-senders 10]           show tokens and dollars spent per day, model and sender`)
+}
+
+// Run a subcommand such as "jot prompt render message.eml".
+func runCommand(args []string) {
+	switch args[0] {
+	case "prompt":
+		promptCommand(args[1:])
+	case "digest":
+		digestCommand(args[1:])
+	case "report":
+		reportCommand(args[1:])
+	case "eval":
+		evalCommand(args[1:])
+	case "search":
+		searchCommand(args[1:])
+	case "ask":
+		askCommand(args[1:])
+	case "feedback":
+		feedbackCommand(args[1:])
+	case "usage":
+		usageCommand(args[1:])
+	case "help", "-h", "-help", "--help":
+		printUsage()
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n", args[0])
+		printUsage()
+		os.Exit(2)
+	}
+}
+
+func promptCommand(args []string) {
+	if len(args) == 0 || args[0] != "render" {
+		printUsage()
+		os.Exit(2)
+	}
+
+	flags := flag.NewFlagSet("prompt render", flag.ExitOnError)
+	templateName := flags.String("template", "action_items", "prompt template to render")
+	flags.Parse(args[1:])
+	if flags.NArg() != 1 {
+		printUsage()
+		os.Exit(2)
+	}
+
+	email, err := parseEMLFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	template := getPromptTemplate(*templateName)
+	fmt.Printf("# Template %s %s, model %s, chat format %s\n", template.Name, template.Version, modelName(), chatFormatName())
+
+	if _, parser, ok := parseKnownEmail(email); ok && *templateName == "action_items" {
+		fmt.Printf("# Analyzed by the %s email parser, no prompt is sent for this email\n", parser)
+	}
+
+	header := formatEmailHeader(email)
+	texts := []string{firstChunk(header, email.body)}
+	if *templateName == "action_items" {
+		texts = emailParts(email, header)
+	}
+
+	for i, text := range texts {
+		if len(texts) > 1 {
+			fmt.Printf("\n# Part %d of %d\n", i+1, len(texts))
+		}
+		fmt.Println(renderPrompt(*templateName, emailPromptData(email, text)).Text)
+	}
+}
+
+func digestCommand(args []string) {
+	flags := flag.NewFlagSet("digest", flag.ExitOnError)
+	day := flags.String("date", time.Now().In(userLocation()).Format("2006-01-02"), "day to write the digest for")
+	flags.Parse(args)
+
+	if _, err := time.Parse("2006-01-02", *day); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid date %q, expected YYYY-MM-DD\n", *day)
+		os.Exit(2)
+	}
+
+	config := getNotionCreds()
+	if err := writeDigest(config.IntegrationSecret, config.ParentPageID, *day); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+func reportCommand(args []string) {
+	if len(args) == 0 || args[0] != "weekly" {
+		printUsage()
+		os.Exit(2)
+	}
+
+	flags := flag.NewFlagSet("report weekly", flag.ExitOnError)
+	endDay := flags.String("end", time.Now().In(userLocation()).Format("2006-01-02"), "last day of the week to report on")
+	markdownFile := flags.String("markdown", "", "write the report to this Markdown file instead of Notion")
+	flags.Parse(args[1:])
+
+	end, err := time.ParseInLocation("2006-01-02", *endDay, userLocation())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid date %q, expected YYYY-MM-DD\n", *endDay)
+		os.Exit(2)
+	}
+
+	if err := writeWeeklyReport(getNotionCreds(), end, *markdownFile); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+func evalCommand(args []string) {
+	flags := flag.NewFlagSet("eval", flag.ExitOnError)
+	configFile := flags.String("config", "", "settings overriding settings.json, e.g. another model or prompt version")
+	compareFile := flags.String("compare", "", "second settings file to compare against")
+	threshold := flags.Float64("threshold", defaultMatchThreshold, "share of words an action item must have in common with an expected one to match it")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		printUsage()
+		os.Exit(2)
+	}
+
+	score, err := runEval(flags.Arg(0), *configFile, *threshold)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	printEvalScore(score)
+	if *compareFile == "" {
+		return
+	}
+
+	other, err := runEval(flags.Arg(0), *compareFile, *threshold)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println()
+	printEvalScore(other)
+	printEvalDiff(score, other)
+}
+
+func searchCommand(args []string) {
+	flags := flag.NewFlagSet("search", flag.ExitOnError)
+	limit := flags.Int("n", 10, "number of results")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		printUsage()
+		os.Exit(2)
+	}
+
+	searchEmails(strings.Join(flags.Args(), " "), *limit)
+}
+
+func askCommand(args []string) {
+	flags := flag.NewFlagSet("ask", flag.ExitOnError)
+	limit := flags.Int("n", defaultAskSources, "number of emails to answer from")
+	var filter AskFilter
+	flags.StringVar(&filter.From, "from", "", "only emails whose sender name or address contains this")
+	flags.StringVar(&filter.Since, "since", "", "only emails from this day on")
+	flags.StringVar(&filter.Until, "until", "", "only emails up to this day")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		printUsage()
+		os.Exit(2)
+	}
+
+	for _, day := range []string{filter.Since, filter.Until} {
+		if _, err := time.Parse("2006-01-02", day); day != "" && err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid date %q, expected YYYY-MM-DD\n", day)
+			os.Exit(2)
+		}
+	}
+
+	askInbox(strings.Join(flags.Args(), " "), *limit, filter)
+}
+
+func feedbackCommand(args []string) {
+	if len(args) != 1 || args[0] != "sync" {
+		printUsage()
+		os.Exit(2)
+	}
+	if err := syncFeedback(getNotionCreds().IntegrationSecret); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usageCommand(args []string) {
+	flags := flag.NewFlagSet("usage", flag.ExitOnError)
+	days := flags.Int("days", 7, "number of days to list")
+	senders := flags.Int("senders", 10, "number of senders to list")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		printUsage()
+		os.Exit(2)
+	}
+
+	printUsageReport(*days, *senders)
+}
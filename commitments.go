@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	commitmentsDatabaseName = "Commitments"
+
+	commitmentTypeMine      = "My Commitment"
+	commitmentTypeWaitingOn = "Waiting On"
+)
+
+// Something promised in a sent email, either by the user or to the user.
+type Commitment struct {
+	Item   string `json:"Item"`
+	Due    string `json:"Due"`
+	Person string `json:"Person"`
+	Type   string `json:"type,omitempty"`
+}
+
+func generateCommitmentsPrompt(email Email, header string) RenderedPrompt {
+	// Only the start of a sent email is the user's own writing, the rest is usually
+	// the quoted thread, so the first chunk is all that is needed
+	return renderPrompt("commitments", emailPromptData(email, firstChunk(header, email.body)))
+}
+
+func parseCommitments(jsonString string) ([]Commitment, error) {
+	type Response struct {
+		MyCommitments []Commitment `json:"MyCommitments"`
+		WaitingOn     []Commitment `json:"WaitingOn"`
+	}
+
+	var response Response
+	if err := json.Unmarshal([]byte(jsonString), &response); err != nil {
+		return nil, err
+	}
+
+	var commitments []Commitment
+	for _, c := range response.MyCommitments {
+		c.Type = commitmentTypeMine
+		commitments = append(commitments, c)
+	}
+	for _, c := range response.WaitingOn {
+		c.Type = commitmentTypeWaitingOn
+		commitments = append(commitments, c)
+	}
+	return commitments, nil
+}
+
+func extractCommitments(prompt RenderedPrompt) []Commitment {
+	commitments, err := completeJSON(prompt, parseCommitments)
+	if err != nil {
+		fmt.Println("Error parsing commitments: ", err)
+	}
+
+	var valid []Commitment
+	for _, c := range commitments {
+		c.Item = strings.TrimSpace(c.Item)
+		if c.Item == "" {
+			continue
+		}
+		// Drop due dates the model did not resolve to a calendar date
+		if _, err := time.Parse("2006-01-02", c.Due); err != nil {
+			c.Due = ""
+		}
+		valid = append(valid, c)
+	}
+	return valid
+}
+
+// The properties of the database sent mail commitments are tracked in.
+func commitmentProperties() map[string]Property {
+	return map[string]Property{
+		"Item": {
+			Type:  "title",
+			Title: &struct{}{},
+		},
+		"Type": {
+			Type: "select",
+			Select: &SelectOptions{Options: []SelectOption{
+				{Name: commitmentTypeMine},
+				{Name: commitmentTypeWaitingOn},
+			}},
+		},
+		"Due": {
+			Type: "date",
+			Date: &struct{}{},
+		},
+		"Person": {
+			Type:     "rich_text",
+			RichText: &struct{}{},
+		},
+		"Subject": {
+			Type:     "rich_text",
+			RichText: &struct{}{},
+		},
+		"Sent": {
+			Type: "date",
+			Date: &struct{}{},
+		},
+		"Done": {
+			Type:     "checkbox",
+			Checkbox: &struct{}{},
+		},
+		"Open in Gmail": {
+			Type: "url",
+			URL:  &struct{}{},
+		},
+	}
+}
+
+// Add a row for each commitment found in a sent email.
+func addCommitmentsToDatabase(integrationSecret, databaseID string, email Email) error {
+	link := messageLink(email)
+	for _, commitment := range email.commitments {
+		page := Page{
+			Parent: Parent{
+				Type:       "database_id",
+				DatabaseID: databaseID,
+			},
+			Properties: map[string]PageProperties{
+				"Item": {
+					Title: plainRichText(commitment.Item),
+				},
+				"Type": {
+					Select: &SelectOption{Name: commitment.Type},
+				},
+				"Person": {
+					RichText: plainRichText(commitment.Person),
+				},
+				"Subject": {
+					RichText: plainRichText(email.subject),
+				},
+				"Sent": {
+					Date: &Date{Start: email.date},
+				},
+			},
+		}
+		if commitment.Due != "" {
+			page.Properties["Due"] = PageProperties{Date: &Date{Start: commitment.Due}}
+		}
+		if link != "" {
+			page.Properties["Open in Gmail"] = PageProperties{URL: &link}
+		}
+
+		if _, err := doNotionRequest(integrationSecret, "POST", "pages", page); err != nil {
+			return fmt.Errorf("failed to add commitment: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Obsolete zone names allowed by RFC 5322 section 4.3
+var obsoleteZones = map[string]string{
+	"UT":  "+0000",
+	"UTC": "+0000",
+	"GMT": "+0000",
+	"EST": "-0500",
+	"EDT": "-0400",
+	"CST": "-0600",
+	"CDT": "-0500",
+	"MST": "-0700",
+	"MDT": "-0600",
+	"PST": "-0800",
+	"PDT": "-0700",
+}
+
+// Layouts tried after net/mail, covering dates seen in the wild that are not valid RFC 5322
+var fallbackDateLayouts = []string{
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04 -0700",
+	"2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04 -0700",
+	"Mon, 2 Jan 2006 15:04:05",
+	"2 Jan 2006 15:04:05",
+	"Mon, Jan 2 2006 15:04:05 -0700",
+	"Mon Jan 2 15:04:05 -0700 2006",
+	time.ANSIC,
+	time.RFC3339,
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05",
+}
+
+// Remove RFC 5322 comments, which may be nested, e.g. "+0000 (UTC)".
+func removeComments(input string) string {
+	var sb strings.Builder
+	depth := 0
+	escaped := false
+	for _, r := range input {
+		switch {
+		case escaped:
+			escaped = false
+			if depth > 0 {
+				continue
+			}
+		case r == '\\' && depth > 0:
+			escaped = true
+			continue
+		case r == '(':
+			depth++
+			continue
+		case r == ')' && depth > 0:
+			depth--
+			continue
+		}
+		if depth == 0 {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// Rewrite the obsolete parts of a date header into their modern equivalents:
+// named and military zones become numeric offsets and two or three digit years
+// are expanded as described in RFC 5322 section 4.3.
+func normalizeDate(input string) string {
+	fields := strings.Fields(removeComments(input))
+	if len(fields) == 0 {
+		return ""
+	}
+
+	last := strings.ToUpper(fields[len(fields)-1])
+	if offset, ok := obsoleteZones[last]; ok {
+		fields[len(fields)-1] = offset
+	} else if len(last) == 1 && last[0] >= 'A' && last[0] <= 'Z' && last != "J" {
+		// Military zones were defined with the wrong sign, so they carry no information
+		fields[len(fields)-1] = "-0000"
+	}
+
+	for i, field := range fields {
+		if _, err := time.Parse("Jan", field); err != nil || i == 0 || i+1 >= len(fields) {
+			continue
+		}
+		// Only the RFC 5322 "day month year" order has a year after the month
+		if _, err := strconv.Atoi(fields[i-1]); err != nil {
+			break
+		}
+		year := fields[i+1]
+		if _, err := strconv.Atoi(year); err != nil {
+			break
+		}
+		switch len(year) {
+		case 2:
+			if n, _ := strconv.Atoi(year); n < 50 {
+				fields[i+1] = "20" + year
+			} else {
+				fields[i+1] = "19" + year
+			}
+		case 3:
+			n, _ := strconv.Atoi(year)
+			fields[i+1] = strconv.Itoa(1900 + n)
+		}
+		break
+	}
+
+	return strings.Join(fields, " ")
+}
+
+// Parse a Date header, accepting the obsolete RFC 5322 syntax as well as common
+// malformed variants. Dates without a zone are taken to be UTC.
+func parseDateHeader(input string) (time.Time, error) {
+	normalized := normalizeDate(input)
+	if normalized == "" {
+		return time.Time{}, fmt.Errorf("empty date")
+	}
+
+	if parsed, err := mail.ParseDate(normalized); err == nil {
+		return parsed, nil
+	}
+
+	for _, layout := range fallbackDateLayouts {
+		if parsed, err := time.Parse(layout, normalized); err == nil {
+			return parsed, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("unrecognised date %q", input)
+}
+
+// Work out when an email was sent. Gmail's internalDate (milliseconds since the
+// epoch) is used when the Date header is missing or cannot be parsed.
+func parseEmailDate(header string, internalDate int64) time.Time {
+	parsed, err := parseDateHeader(header)
+	if err == nil {
+		return parsed
+	}
+
+	if internalDate > 0 {
+		fmt.Println("Error parsing date, using Gmail's internal date:", err)
+		return time.UnixMilli(internalDate)
+	}
+
+	fmt.Println("Error parsing date, using the current time:", err)
+	return time.Now()
+}
+
+// Format a time in the user's timezone for display in Notion.
+func formatDate(t time.Time) string {
+	return t.In(userLocation()).Format(time.RFC3339)
+}
+
+// The day an email belongs to in the user's timezone, used to group emails into databases.
+func emailDay(email Email) string {
+	received := email.received
+	if received.IsZero() {
+		received = time.Now()
+	}
+	return received.In(userLocation()).Format("2006-01-02")
+}
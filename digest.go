@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	digestsFileName       = "digests.json"
+	uncategorizedCategory = "Uncategorized"
+)
+
+// An email row read back from a daily database.
+type EmailRow struct {
+	ID          string
+	Subject     string
+	From        string
+	SenderEmail string
+	Summary     string
+	Priority    string
+	Categories  []string
+	ActionItems []ActionItem
+	URL         string
+}
+
+// An action item in the digest with the row it came from.
+type DigestActionItem struct {
+	ActionItem
+	Subject string
+	URL     string
+}
+
+// Read the IDs of the digest pages created so far, by day.
+func readDigestPages() (map[string]string, error) {
+	pages := make(map[string]string)
+	data, err := os.ReadFile(digestsFileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return pages, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &pages); err != nil {
+		return nil, err
+	}
+	return pages, nil
+}
+
+func writeDigestPages(pages map[string]string) error {
+	data, err := json.MarshalIndent(pages, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(digestsFileName, data, 0644)
+}
+
+// Read the rows of a day's database that match a Notion filter, all of them when
+// the filter is nil.
+func readEmailRows(integrationSecret, databaseID string, filter any) ([]EmailRow, error) {
+	pages, err := queryDatabase(integrationSecret, databaseID, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	emails := make([]EmailRow, 0, len(pages))
+	for _, page := range pages {
+		email := EmailRow{
+			ID:          page.ID,
+			Subject:     propertyText(page.Properties["Subject"]),
+			From:        propertyText(page.Properties["Email From"]),
+			Summary:     propertyText(page.Properties["Summary"]),
+			Categories:  propertyOptions(page.Properties["Categories"]),
+			ActionItems: parseActionItemsText(propertyText(page.Properties["Action Items"])),
+			URL:         page.URL,
+		}
+		if senderEmail := page.Properties["Sender Email"].Email; senderEmail != nil {
+			email.SenderEmail = *senderEmail
+		}
+		if priority := page.Properties["Priority"].Select; priority != nil {
+			email.Priority = priority.Name
+		}
+		if email.Subject == "" {
+			email.Subject = "(no subject)"
+		}
+		emails = append(emails, email)
+	}
+	return emails, nil
+}
+
+// Group emails by their first category, with the categories in the configured
+// order followed by any others alphabetically and uncategorized emails last.
+func groupByCategory(emails []EmailRow) ([]string, map[string][]EmailRow) {
+	groups := make(map[string][]EmailRow)
+	for _, email := range emails {
+		category := uncategorizedCategory
+		if len(email.Categories) > 0 {
+			category = email.Categories[0]
+		}
+		groups[category] = append(groups[category], email)
+	}
+
+	rank := make(map[string]int)
+	for i, category := range getConfiguration().Categories {
+		rank[category.Name] = i + 1
+	}
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := names[i], names[j]
+		if (a == uncategorizedCategory) != (b == uncategorizedCategory) {
+			return b == uncategorizedCategory
+		}
+		if rank[a] != rank[b] {
+			if rank[a] == 0 || rank[b] == 0 {
+				return rank[b] == 0
+			}
+			return rank[a] < rank[b]
+		}
+		return a < b
+	})
+	return names, groups
+}
+
+// Every distinct action item of the day, earliest due first and undated ones last.
+func digestActionItems(emails []EmailRow) []DigestActionItem {
+	var items []DigestActionItem
+	seen := make(map[string]int)
+	for _, email := range emails {
+		for _, item := range email.ActionItems {
+			key := normalizeActionItem(item.Task)
+			if key == "" {
+				continue
+			}
+			if i, ok := seen[key]; ok {
+				if items[i].Due == "" {
+					items[i].Due = item.Due
+				}
+				continue
+			}
+			seen[key] = len(items)
+			items = append(items, DigestActionItem{ActionItem: item, Subject: email.Subject, URL: email.URL})
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		if (items[i].Due == "") != (items[j].Due == "") {
+			return items[j].Due == ""
+		}
+		return items[i].Due < items[j].Due
+	})
+	return items
+}
+
+// The day's emails as text for the digest prompt, cut to the chunk token budget.
+func formatDigestForPrompt(categories []string, groups map[string][]EmailRow) string {
+	var sb strings.Builder
+	for _, category := range categories {
+		sb.WriteString(category + ":\n")
+		for _, email := range groups[category] {
+			sb.WriteString("- " + email.Subject + " (from " + email.From)
+			if email.Priority != "" {
+				sb.WriteString(", " + email.Priority + " priority")
+			}
+			sb.WriteString("): " + email.Summary + "\n")
+			for _, item := range email.ActionItems {
+				sb.WriteString("  * " + item.Task)
+				if item.Due != "" {
+					sb.WriteString(" (due " + item.Due + ")")
+				}
+				sb.WriteString("\n")
+			}
+		}
+		sb.WriteString("\n")
+	}
+
+	text := strings.TrimSpace(sb.String())
+	chunkTokens, _, _ := chunkSettings()
+	if countTokens(text) > chunkTokens {
+		text = splitByTokens(text, chunkTokens)[0]
+	}
+	return text
+}
+
+func generateDigestPrompt(day, emails string) RenderedPrompt {
+	data := userPromptData()
+	data["Date"] = day
+	data["Emails"] = emails
+	return renderPrompt("digest", data)
+}
+
+// The blocks of a digest page: the narrative, the consolidated action list and
+// the emails of each category, linking back to their rows.
+func digestBlocks(narrative string, categories []string, groups map[string][]EmailRow, items []DigestActionItem) []Block {
+	blocks := []Block{headingBlock(2, "Overview")}
+	for _, paragraph := range strings.Split(narrative, "\n\n") {
+		if paragraph = strings.TrimSpace(paragraph); paragraph != "" {
+			blocks = append(blocks, paragraphBlock(plainRichText(paragraph)))
+		}
+	}
+
+	blocks = append(blocks, headingBlock(2, "Action Items"))
+	if len(items) == 0 {
+		blocks = append(blocks, paragraphBlock(plainRichText("No action items")))
+	}
+	for _, item := range items {
+		task := item.Task
+		if item.Due != "" {
+			task += " (due " + item.Due + ")"
+		}
+		blocks = append(blocks, Block{
+			Object: "block",
+			Type:   "to_do",
+			ToDo:   &TextBlock{Text: append(plainRichText(task+" - "), linkText(item.Subject, item.URL))},
+		})
+	}
+
+	blocks = append(blocks, headingBlock(2, "Emails"))
+	for _, category := range categories {
+		blocks = append(blocks, headingBlock(3, category))
+		for _, email := range groups[category] {
+			text := []RichText{linkText(email.Subject, email.URL)}
+			text = append(text, plainRichText(" from "+email.From+": "+email.Summary)...)
+			blocks = append(blocks, bulletBlock(text))
+		}
+	}
+	return blocks
+}
+
+// Write the digest page for a day under the parent page, replacing the one
+// written by an earlier run.
+func writeDigest(integrationSecret, parentPageID, day string) error {
+	dbInfoList, err := readDatabaseInfo(day + "-Database")
+	if err != nil {
+		return fmt.Errorf("error reading database info: %v", err)
+	}
+	dbID, ok := findDatabaseID(dbInfoList, day+"-Database")
+	if !ok {
+		return fmt.Errorf("no database for %s", day)
+	}
+
+	emails, err := readEmailRows(integrationSecret, dbID, nil)
+	if err != nil {
+		return err
+	}
+	if len(emails) == 0 {
+		return nil
+	}
+
+	categories, groups := groupByCategory(emails)
+	prompt := generateDigestPrompt(day, formatDigestForPrompt(categories, groups))
+	narrative, _, err := callLLM(prompt)
+	if err != nil {
+		return fmt.Errorf("error writing the digest narrative: %v", err)
+	}
+	blocks := digestBlocks(narrative, categories, groups, digestActionItems(emails))
+
+	digestPages, err := readDigestPages()
+	if err != nil {
+		return fmt.Errorf("error reading digest pages: %v", err)
+	}
+
+	// Write the new digest before removing the previous one, so a failure leaves
+	// the previous one in place
+	page, err := createChildPage(integrationSecret, parentPageID, day+"-Digest", blocks)
+	if err != nil {
+		if page.ID != "" {
+			if archiveErr := archivePage(integrationSecret, page.ID); archiveErr != nil {
+				fmt.Fprintf(os.Stderr, "Error removing the incomplete digest: %v\n", archiveErr)
+			}
+		}
+		return err
+	}
+	if pageID, ok := digestPages[day]; ok {
+		if err := archivePage(integrationSecret, pageID); err != nil {
+			fmt.Fprintf(os.Stderr, "Error removing the previous digest: %v\n", err)
+		}
+	}
+	digestPages[day] = page.ID
+	if err := writeDigestPages(digestPages); err != nil {
+		return fmt.Errorf("error writing digest pages: %v", err)
+	}
+
+	fmt.Printf("Digest for %s written to %s\n", day, page.URL)
+	return nil
+}
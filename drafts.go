@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/url"
+	"strings"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func generateReplyPrompt(email Email, header string) RenderedPrompt {
+	return renderPrompt("reply", emailPromptData(email, firstChunk(header, email.body)))
+}
+
+type ReplySuggestion struct {
+	NeedsReply bool   `json:"NeedsReply"`
+	Reply      string `json:"Reply"`
+}
+
+func parseReply(jsonString string) (ReplySuggestion, error) {
+	var response ReplySuggestion
+	if err := json.Unmarshal([]byte(jsonString), &response); err != nil {
+		return ReplySuggestion{}, err
+	}
+	response.Reply = strings.TrimSpace(response.Reply)
+	return response, nil
+}
+
+// Build the raw RFC 5322 reply, threaded with the original through In-Reply-To and References.
+func buildReplyMessage(email Email, reply string) string {
+	to := email.replyTo
+	if len(to) == 0 && email.sender != nil {
+		to = []*mail.Address{email.sender}
+	}
+	recipients := make([]string, len(to))
+	for i, address := range to {
+		recipients[i] = address.String()
+	}
+
+	subject := email.subject
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = "Re: " + subject
+	}
+
+	references := append([]string{}, email.references...)
+	if email.messageID != "" {
+		references = append(references, email.messageID)
+	}
+
+	var sb strings.Builder
+	sb.WriteString("To: " + strings.Join(recipients, ", ") + "\r\n")
+	sb.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n")
+	if email.messageID != "" {
+		sb.WriteString("In-Reply-To: " + email.messageID + "\r\n")
+	}
+	if len(references) > 0 {
+		sb.WriteString("References: " + strings.Join(references, " ") + "\r\n")
+	}
+	sb.WriteString("MIME-Version: 1.0\r\n")
+	sb.WriteString("Content-Type: text/plain; charset=\"UTF-8\"\r\n")
+	sb.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	sb.WriteString("\r\n")
+	sb.WriteString(strings.ReplaceAll(reply, "\n", "\r\n"))
+	return sb.String()
+}
+
+// Save a reply as a draft in the original message's thread.
+func createReplyDraft(srv *gmail.Service, user string, email Email, reply string) (*gmail.Draft, error) {
+	draft := &gmail.Draft{
+		Message: &gmail.Message{
+			Raw:      base64.URLEncoding.EncodeToString([]byte(buildReplyMessage(email, reply))),
+			ThreadId: email.threadID,
+		},
+	}
+	created, err := srv.Users.Drafts.Create(user, draft).Do()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create draft: %v", err)
+	}
+	return created, nil
+}
+
+// Link that opens a draft in the Gmail web client.
+func draftLink(email Email, draft *gmail.Draft) string {
+	account := email.account
+	if account == "" {
+		account = "0"
+	}
+	return fmt.Sprintf("https://mail.google.com/mail/u/%s/#drafts?compose=%s", url.PathEscape(account), draft.Message.Id)
+}
+
+// Ask the LLM whether the email needs a reply and save the suggested reply as a
+// draft. Returns the link to the draft, or "" when no draft was made.
+func draftReply(srv *gmail.Service, user string, email Email, header string) string {
+	if email.sender == nil && len(email.replyTo) == 0 {
+		return ""
+	}
+
+	suggestion, err := completeJSON(generateReplyPrompt(email, header), parseReply)
+	if err != nil {
+		fmt.Println("Error parsing reply: ", err)
+		return ""
+	}
+	if !suggestion.NeedsReply || suggestion.Reply == "" {
+		return ""
+	}
+
+	draft, err := createReplyDraft(srv, user, email, suggestion.Reply)
+	if err != nil {
+		fmt.Println("Error saving reply draft: ", err)
+		return ""
+	}
+	return draftLink(email, draft)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"strings"
+
+	"golang.org/x/net/html/charset"
+)
+
+// Read an email saved as an .eml file into an Email, the same way parseEmails
+// builds one from a Gmail message.
+func parseEMLFile(path string) (Email, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Email{}, err
+	}
+	defer f.Close()
+
+	msg, err := mail.ReadMessage(f)
+	if err != nil {
+		return Email{}, fmt.Errorf("unable to parse %s: %v", path, err)
+	}
+
+	headers := make(map[string]string)
+	for name, values := range msg.Header {
+		if len(values) > 0 {
+			headers[name] = values[0]
+		}
+	}
+
+	html, plain, err := readMIMEText(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+	if err != nil {
+		return Email{}, fmt.Errorf("unable to read the body of %s: %v", path, err)
+	}
+
+	email := newEmailFromHeaders(headers)
+	if html != "" {
+		email.body, err = getAllTextFromHTML(html)
+		if err != nil {
+			return Email{}, err
+		}
+		email.html = html
+		email.links = extractLinks(html)
+	} else {
+		email.body = strings.Split(plain, "\n")
+	}
+	email.received = parseEmailDate(headers["Date"], 0)
+	email.date = formatDate(email.received)
+	return email, nil
+}
+
+// Walk a MIME body and collect its HTML and plain text parts, decoded to UTF-8.
+func readMIMEText(contentType, transferEncoding string, body io.Reader) (string, string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// Messages without a Content-Type are plain text
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		var html, plain string
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return html, plain, err
+			}
+			partHTML, partPlain, err := readMIMEText(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part)
+			if err != nil {
+				return html, plain, err
+			}
+			html += partHTML
+			plain += partPlain
+		}
+		return html, plain, nil
+	}
+
+	if mediaType != "text/html" && mediaType != "text/plain" {
+		return "", "", nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(transferEncoding)) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	if label := params["charset"]; label != "" && !strings.EqualFold(label, "utf-8") {
+		body, err = charset.NewReaderLabel(label, body)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return "", "", err
+	}
+	if mediaType == "text/html" {
+		return string(data), "", nil
+	}
+	return "", string(data), nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const entitiesSchemaFile = "entities.schema.json"
+
+// Things mentioned in an email that are worth finding again later.
+type Entities struct {
+	People           []string          `json:"people"`
+	Organizations    []string          `json:"organizations"`
+	Amounts          []Amount          `json:"-"`
+	Dates            []string          `json:"-"`
+	ReferenceNumbers []ReferenceNumber `json:"-"`
+	URLs             []string          `json:"-"`
+}
+
+// A monetary amount, with the currency as an ISO 4217 code and the value without
+// thousands separators. Text is the amount as written in the email.
+type Amount struct {
+	Currency string
+	Value    string
+	Text     string
+}
+
+// An order, invoice or tracking number.
+type ReferenceNumber struct {
+	Kind  string
+	Value string
+}
+
+var currencySymbols = map[string]string{
+	"$": "USD",
+	"€": "EUR",
+	"£": "GBP",
+	"¥": "JPY",
+	"₹": "INR",
+}
+
+const currencyCodes = `USD|EUR|GBP|JPY|INR|CAD|AUD|CHF|CNY|SEK|NOK|DKK|NZD|SGD|HKD|MXN|BRL`
+
+var (
+	symbolAmountRegex = regexp.MustCompile(`([$€£¥₹])\s?(\d{1,3}(?:,\d{3})+(?:\.\d{1,2})?|\d+(?:\.\d{1,2})?)\b`)
+	codeAmountRegex   = regexp.MustCompile(`\b(` + currencyCodes + `)\s?(\d{1,3}(?:,\d{3})+(?:\.\d{1,2})?|\d+(?:\.\d{1,2})?)\b`)
+	amountCodeRegex   = regexp.MustCompile(`\b(\d{1,3}(?:,\d{3})+(?:\.\d{1,2})?|\d+(?:\.\d{1,2})?)\s?(` + currencyCodes + `)\b`)
+
+	dateRegexes = []*regexp.Regexp{
+		regexp.MustCompile(`\b\d{4}-\d{2}-\d{2}\b`),
+		regexp.MustCompile(`\b\d{1,2}/\d{1,2}/\d{2,4}\b`),
+		regexp.MustCompile(`(?i)\b(?:Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Sept|Oct|Nov|Dec)[a-z]*\.? \d{1,2}(?:st|nd|rd|th)?,? \d{4}\b`),
+		regexp.MustCompile(`(?i)\b\d{1,2}(?:st|nd|rd|th)? (?:Jan|Feb|Mar|Apr|May|Jun|Jul|Aug|Sep|Sept|Oct|Nov|Dec)[a-z]*\.?,? \d{4}\b`),
+	}
+
+	referenceRegexes = []struct {
+		kind  string
+		regex *regexp.Regexp
+	}{
+		{"Tracking (UPS)", regexp.MustCompile(`\b1Z[0-9A-Z]{16}\b`)},
+		{"Tracking (USPS)", regexp.MustCompile(`\b(?:94|93|92|95)\d{18,20}\b`)},
+		{"Tracking", regexp.MustCompile(`(?i)\btracking\s*(?:number|no\.?|#|id)?\s*[:#]?\s*([A-Z0-9]{10,30})\b`)},
+		{"Invoice", regexp.MustCompile(`(?i)\binvoice\s*(?:number|no\.?|#|id)?\s*[:#]?\s*([A-Z0-9][A-Z0-9-]{3,})\b`)},
+		{"Order", regexp.MustCompile(`(?i)\b(?:order|purchase order|PO)\s*(?:number|no\.?|#|id)?\s*[:#]?\s*([A-Z0-9][A-Z0-9-]{3,})\b`)},
+	}
+
+	urlRegex = regexp.MustCompile(`https?://[^\s<>"']+`)
+)
+
+// The regex extractors match "Invoice" followed by an ordinary word as well, so
+// reference numbers must contain at least one digit.
+var digitRegex = regexp.MustCompile(`\d`)
+
+type stringSet struct {
+	seen   map[string]bool
+	values []string
+}
+
+func (s *stringSet) add(value string) {
+	if s.seen == nil {
+		s.seen = make(map[string]bool)
+	}
+	key := strings.ToLower(value)
+	if value == "" || s.seen[key] {
+		return
+	}
+	s.seen[key] = true
+	s.values = append(s.values, value)
+}
+
+func extractAmounts(text string) []Amount {
+	var amounts []Amount
+	seen := make(map[string]bool)
+	add := func(currency, value, original string) {
+		value = strings.ReplaceAll(value, ",", "")
+		key := currency + value
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		amounts = append(amounts, Amount{Currency: currency, Value: value, Text: strings.TrimSpace(original)})
+	}
+
+	for _, m := range symbolAmountRegex.FindAllStringSubmatch(text, -1) {
+		add(currencySymbols[m[1]], m[2], m[0])
+	}
+	for _, m := range codeAmountRegex.FindAllStringSubmatch(text, -1) {
+		add(m[1], m[2], m[0])
+	}
+	for _, m := range amountCodeRegex.FindAllStringSubmatch(text, -1) {
+		add(m[2], m[1], m[0])
+	}
+	return amounts
+}
+
+func extractReferenceNumbers(text string) []ReferenceNumber {
+	var references []ReferenceNumber
+	seen := make(map[string]bool)
+	for _, extractor := range referenceRegexes {
+		for _, m := range extractor.regex.FindAllStringSubmatch(text, -1) {
+			value := m[len(m)-1]
+			if !digitRegex.MatchString(value) || seen[value] {
+				continue
+			}
+			seen[value] = true
+			references = append(references, ReferenceNumber{Kind: extractor.kind, Value: value})
+		}
+	}
+	return references
+}
+
+// Run the deterministic extractors for the well-formed entities.
+func extractRegexEntities(text string) Entities {
+	var entities Entities
+	entities.Amounts = extractAmounts(text)
+	entities.ReferenceNumbers = extractReferenceNumbers(text)
+
+	var dates stringSet
+	for _, re := range dateRegexes {
+		for _, match := range re.FindAllString(text, -1) {
+			dates.add(match)
+		}
+	}
+	entities.Dates = dates.values
+
+	var urls stringSet
+	for _, match := range urlRegex.FindAllString(text, -1) {
+		urls.add(strings.TrimRight(match, ".,;:!?)]"))
+	}
+	entities.URLs = urls.values
+	return entities
+}
+
+func generateEntitiesPrompt(email Email, header string) RenderedPrompt {
+	return renderPrompt("entities", emailPromptData(email, firstChunk(header, email.body)))
+}
+
+var (
+	entitiesSchema     *JSONSchema
+	entitiesSchemaOnce sync.Once
+)
+
+func getEntitiesSchema() *JSONSchema {
+	entitiesSchemaOnce.Do(func() {
+		schema, err := loadJSONSchema(entitiesSchemaFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		entitiesSchema = schema
+	})
+	return entitiesSchema
+}
+
+// Parse the people and organizations the LLM found.
+func parseNamedEntities(completion string) (Entities, error) {
+	var named Entities
+	err := decodeValidated(completion, getEntitiesSchema(), &named)
+	return named, err
+}
+
+// Extract the entities in an email: regexes for amounts, dates, reference numbers
+// and URLs, and the people and organizations the LLM named in its analysis.
+func extractEntities(email Email, header string, analysis EmailAnalysis) Entities {
+	entities := extractRegexEntities(email.subject + "\n" + strings.Join(email.body, "\n"))
+	if email.parser != "" || email.analysisError != "" {
+		// Emails from known systems, and those the model could not analyze, only get
+		// the entities found by the regexes
+		return entities
+	}
+
+	named := Entities{People: analysis.People, Organizations: analysis.Organizations}
+	if named.People == nil && named.Organizations == nil {
+		// A pinned analysis template that does not list them, ask separately
+		var err error
+		named, err = completeJSON(generateEntitiesPrompt(email, header), parseNamedEntities)
+		if err != nil {
+			fmt.Println("Error parsing entities: ", err)
+			return entities
+		}
+	}
+
+	var people, organizations stringSet
+	for _, name := range named.People {
+		people.add(strings.TrimSpace(name))
+	}
+	for _, name := range named.Organizations {
+		organizations.add(strings.TrimSpace(name))
+	}
+	entities.People = people.values
+	entities.Organizations = organizations.values
+	return entities
+}
+
+func formatAmounts(amounts []Amount) string {
+	lines := make([]string, len(amounts))
+	for i, amount := range amounts {
+		lines[i] = fmt.Sprintf("%s %s (%s)", amount.Currency, amount.Value, amount.Text)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func formatReferenceNumbers(references []ReferenceNumber) string {
+	lines := make([]string, len(references))
+	for i, reference := range references {
+		lines[i] = reference.Kind + ": " + reference.Value
+	}
+	return strings.Join(lines, "\n")
+}
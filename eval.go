@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultMatchThreshold = 0.5
+
+// A labeled email: name.eml with the action items expected from it in name.json.
+type EvalFixture struct {
+	Name     string
+	Email    Email
+	Expected []ActionItem
+}
+
+// The result of extracting action items from one fixture.
+type EvalResult struct {
+	Name          string
+	Expected      []ActionItem
+	Predicted     []ActionItem
+	Matched       int
+	Calls         int
+	CallFailures  int
+	ParseFailures int
+	Latency       time.Duration
+}
+
+// Totals over every fixture for one configuration.
+type EvalScore struct {
+	Label         string
+	Expected      int
+	Predicted     int
+	Matched       int
+	Calls         int
+	CallFailures  int
+	ParseFailures int
+	Latency       time.Duration
+	Results       []EvalResult
+}
+
+func (s EvalScore) precision() float64 {
+	if s.Predicted == 0 {
+		return 1
+	}
+	return float64(s.Matched) / float64(s.Predicted)
+}
+
+func (s EvalScore) recall() float64 {
+	if s.Expected == 0 {
+		return 1
+	}
+	return float64(s.Matched) / float64(s.Expected)
+}
+
+// The share of calls that failed or timed out without an answer.
+func (s EvalScore) callFailureRate() float64 {
+	if s.Calls == 0 {
+		return 0
+	}
+	return float64(s.CallFailures) / float64(s.Calls)
+}
+
+// The share of answers that could not be parsed.
+func (s EvalScore) parseFailureRate() float64 {
+	answers := s.Calls - s.CallFailures
+	if answers == 0 {
+		return 0
+	}
+	return float64(s.ParseFailures) / float64(answers)
+}
+
+func (s EvalScore) meanLatency() time.Duration {
+	if s.Calls == 0 {
+		return 0
+	}
+	return s.Latency / time.Duration(s.Calls)
+}
+
+// Read every .eml in dir that has a .json file of expected action items next to it.
+// The emails' dates are resolved in the timezone of the current settings.
+func loadEvalFixtures(dir string) ([]EvalFixture, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	var fixtures []EvalFixture
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".eml")
+		data, err := os.ReadFile(strings.TrimSuffix(file, ".eml") + ".json")
+		if err != nil {
+			if os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "Skipping %s, it has no %s.json with the expected action items\n", file, name)
+				continue
+			}
+			return nil, err
+		}
+
+		var expected struct {
+			ActionItems []ActionItem `json:"action_items"`
+		}
+		if err := json.Unmarshal(data, &expected); err != nil {
+			return nil, fmt.Errorf("unable to parse %s.json: %v", name, err)
+		}
+		email, err := parseEMLFile(file)
+		if err != nil {
+			return nil, err
+		}
+		fixtures = append(fixtures, EvalFixture{Name: name, Email: email, Expected: expected.ActionItems})
+	}
+	return fixtures, nil
+}
+
+// How alike two action items are, as the share of their words they have in common.
+func actionItemSimilarity(a, b string) float64 {
+	wordsA := strings.Fields(normalizeActionItem(a))
+	wordsB := strings.Fields(normalizeActionItem(b))
+	if len(wordsA) == 0 || len(wordsB) == 0 {
+		return 0
+	}
+
+	inA := make(map[string]bool, len(wordsA))
+	for _, word := range wordsA {
+		inA[word] = true
+	}
+	union := len(inA)
+	common := 0
+	seen := make(map[string]bool, len(wordsB))
+	for _, word := range wordsB {
+		if seen[word] {
+			continue
+		}
+		seen[word] = true
+		if inA[word] {
+			common++
+		} else {
+			union++
+		}
+	}
+	return float64(common) / float64(union)
+}
+
+// Pair predicted with expected action items, most similar pairs first, and count
+// the pairs at least threshold alike. Each item is used in at most one pair.
+func matchActionItems(expected, predicted []ActionItem, threshold float64) int {
+	type pair struct {
+		e, p       int
+		similarity float64
+	}
+	var pairs []pair
+	for e := range expected {
+		for p := range predicted {
+			if similarity := actionItemSimilarity(expected[e].Task, predicted[p].Task); similarity >= threshold {
+				pairs = append(pairs, pair{e, p, similarity})
+			}
+		}
+	}
+	sort.SliceStable(pairs, func(i, j int) bool {
+		return pairs[i].similarity > pairs[j].similarity
+	})
+
+	usedExpected := make(map[int]bool)
+	usedPredicted := make(map[int]bool)
+	matched := 0
+	for _, pair := range pairs {
+		if usedExpected[pair.e] || usedPredicted[pair.p] {
+			continue
+		}
+		usedExpected[pair.e] = true
+		usedPredicted[pair.p] = true
+		matched++
+	}
+	return matched
+}
+
+// Extract action items from a fixture the way a run does, with the email parsers
+// and then the model without the cache or the fallbacks so only the configured
+// model is scored, counting the model calls that failed and the answers that
+// could not be parsed.
+func evaluateFixture(fixture EvalFixture, threshold float64) EvalResult {
+	result := EvalResult{Name: fixture.Name, Expected: fixture.Expected}
+	backend := llmBackends()[0]
+	extract := func(prompt RenderedPrompt) (EmailAnalysis, bool) {
+		start := time.Now()
+		completion, err := complete(backend, prompt)
+		result.Latency += time.Since(start)
+		result.Calls++
+		if err != nil {
+			fmt.Printf("%s failed on %s: %v\n", backend.name(), fixture.Name, err)
+			result.CallFailures++
+			return EmailAnalysis{}, false
+		}
+
+		analysis, err := parseAnalysis(completion)
+		if err != nil {
+			result.ParseFailures++
+			return analysis, false
+		}
+		return analysis, true
+	}
+
+	if parsed, _, ok := parseKnownEmail(fixture.Email); ok {
+		result.Predicted = parsed.ActionItems
+		result.Matched = matchActionItems(result.Expected, result.Predicted, threshold)
+		return result
+	}
+
+	header := formatEmailHeader(fixture.Email)
+	var analyses []EmailAnalysis
+	for _, part := range emailParts(fixture.Email, header) {
+		if analysis, ok := extract(generatePrompt(fixture.Email, part)); ok {
+			analyses = append(analyses, analysis)
+		}
+	}
+
+	var analysis EmailAnalysis
+	switch {
+	case len(analyses) == 1:
+		analysis = analyses[0]
+	case len(analyses) > 1:
+		merged, ok := extract(generateMergePrompt(fixture.Email, analyses))
+		if !ok {
+			merged = mergeAnalyses(analyses)
+		}
+		analysis = merged
+	}
+
+	result.Predicted = analysis.ActionItems
+	result.Matched = matchActionItems(result.Expected, result.Predicted, threshold)
+	return result
+}
+
+// Score every fixture in dir with the settings from settings.json overridden by
+// configFile. The fixtures are loaded after the settings are applied, so their
+// dates are in that configuration's timezone.
+func runEval(dir, configFile string, threshold float64) (EvalScore, error) {
+	files := []string{settingsFileName}
+	if configFile != "" {
+		if _, err := os.Stat(configFile); err != nil {
+			return EvalScore{}, err
+		}
+		files = append(files, configFile)
+	}
+	config, err := readConfiguration(files...)
+	if err != nil {
+		return EvalScore{}, err
+	}
+	setConfiguration(config)
+
+	fixtures, err := loadEvalFixtures(dir)
+	if err != nil {
+		return EvalScore{}, err
+	}
+	if len(fixtures) == 0 {
+		return EvalScore{}, fmt.Errorf("no fixtures found in %s", dir)
+	}
+
+	score := EvalScore{Label: configFile}
+	if score.Label == "" {
+		score.Label = settingsFileName
+	}
+	for _, fixture := range fixtures {
+		result := evaluateFixture(fixture, threshold)
+		score.Results = append(score.Results, result)
+		score.Expected += len(result.Expected)
+		score.Predicted += len(result.Predicted)
+		score.Matched += result.Matched
+		score.Calls += result.Calls
+		score.CallFailures += result.CallFailures
+		score.ParseFailures += result.ParseFailures
+		score.Latency += result.Latency
+	}
+	return score, nil
+}
+
+func printEvalScore(score EvalScore) {
+	fmt.Printf("# %s: provider %s, model %s, action_items %s\n\n",
+		score.Label, providerName(), modelName(), getPromptTemplate("action_items").Version)
+	for _, result := range score.Results {
+		fmt.Printf("%-30s expected %2d  predicted %2d  matched %2d  call failures %d  parse failures %d\n",
+			result.Name, len(result.Expected), len(result.Predicted), result.Matched, result.CallFailures, result.ParseFailures)
+	}
+	fmt.Printf("\nPrecision %.2f  Recall %.2f  Call failure rate %.2f  Parse failure rate %.2f  Mean latency %s\n",
+		score.precision(), score.recall(), score.callFailureRate(), score.parseFailureRate(), score.meanLatency().Round(time.Millisecond))
+}
+
+// Print the totals of two configurations side by side, then the fixtures they
+// scored differently.
+func printEvalDiff(a, b EvalScore) {
+	fmt.Printf("\n# %s vs %s\n\n", a.Label, b.Label)
+	fmt.Printf("%-20s %10s %10s %10s\n", "", "A", "B", "B - A")
+	row := func(name string, x, y float64) {
+		fmt.Printf("%-20s %10.2f %10.2f %+10.2f\n", name, x, y, y-x)
+	}
+	row("Precision", a.precision(), b.precision())
+	row("Recall", a.recall(), b.recall())
+	row("Call failure rate", a.callFailureRate(), b.callFailureRate())
+	row("Parse failure rate", a.parseFailureRate(), b.parseFailureRate())
+	row("Mean latency (s)", a.meanLatency().Seconds(), b.meanLatency().Seconds())
+
+	var changed []string
+	for i := range a.Results {
+		ra, rb := a.Results[i], b.Results[i]
+		if ra.Matched != rb.Matched || len(ra.Predicted) != len(rb.Predicted) || ra.CallFailures != rb.CallFailures || ra.ParseFailures != rb.ParseFailures {
+			changed = append(changed, fmt.Sprintf("%-30s matched %d -> %d  predicted %d -> %d  call failures %d -> %d  parse failures %d -> %d",
+				ra.Name, ra.Matched, rb.Matched, len(ra.Predicted), len(rb.Predicted), ra.CallFailures, rb.CallFailures, ra.ParseFailures, rb.ParseFailures))
+		}
+	}
+	if len(changed) > 0 {
+		fmt.Println("\nChanged fixtures:")
+		for _, line := range changed {
+			fmt.Println(line)
+		}
+	}
+}
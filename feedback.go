@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	feedbackFileName = "feedback.json"
+
+	// How long rows are watched for corrections after Jot writes them
+	feedbackWindow = 14 * 24 * time.Hour
+	// Notion rounds edit times down to the minute
+	feedbackEditMargin = time.Minute
+	// Token budget of the email text kept with each example
+	feedbackTextTokens     = 300
+	defaultFewShotExamples = 2
+)
+
+// What Jot wrote for an email, kept so later edits in Notion can be told apart.
+type FeedbackRecord struct {
+	PageID     string        `json:"pageId"`
+	DatabaseID string        `json:"databaseId"`
+	Sender     string        `json:"sender"`
+	Subject    string        `json:"subject"`
+	Text       string        `json:"text"`
+	Output     EmailAnalysis `json:"output"`
+	Created    time.Time     `json:"created"`
+}
+
+// An email with the output a human corrected it to.
+type FeedbackExample struct {
+	PageID    string        `json:"pageId"`
+	Sender    string        `json:"sender"`
+	Subject   string        `json:"subject"`
+	Text      string        `json:"text"`
+	Output    EmailAnalysis `json:"output"`
+	Corrected time.Time     `json:"corrected"`
+}
+
+type FeedbackStore struct {
+	mu       sync.Mutex
+	Records  []FeedbackRecord  `json:"records"`
+	Examples []FeedbackExample `json:"examples"`
+	// When the rows were last read back, only rows edited since are read again
+	LastSync time.Time `json:"lastSync"`
+}
+
+func readFeedbackStore() (*FeedbackStore, error) {
+	store := &FeedbackStore{}
+	data, err := os.ReadFile(feedbackFileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, store); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", feedbackFileName, err)
+	}
+	return store, nil
+}
+
+func (store *FeedbackStore) save() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	data, err := json.MarshalIndent(store, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(feedbackFileName, data, 0600)
+}
+
+// Remember what was written to a new row.
+func (store *FeedbackStore) addRecord(pageID, databaseID string, email Email) {
+	record := FeedbackRecord{
+		PageID:     pageID,
+		DatabaseID: databaseID,
+		Subject:    email.subject,
+		Text:       feedbackText(email),
+		Output: EmailAnalysis{
+			Summary:     email.summary,
+			ActionItems: email.actionItems,
+			Categories:  email.categories,
+			NeedsReply:  email.needsReply,
+			KeyDates:    email.keyDates,
+		},
+		Created: time.Now(),
+	}
+	if email.sender != nil {
+		record.Sender = strings.ToLower(email.sender.Address)
+	}
+
+	store.mu.Lock()
+	store.Records = append(store.Records, record)
+	store.mu.Unlock()
+}
+
+// The start of an email as shown in a few-shot example.
+func feedbackText(email Email) string {
+	text := firstChunk(formatEmailHeader(email), email.body)
+	if countTokens(text) > feedbackTextTokens {
+		text = splitByTokens(text, feedbackTextTokens)[0]
+	}
+	// Keep the separators templates put around the email out of the examples
+	return strings.ReplaceAll(text, "***", "")
+}
+
+// Whether two outputs have the same summary and action items, ignoring case,
+// punctuation and the order of the action items.
+func sameOutput(a, b EmailAnalysis) bool {
+	return normalizeActionItem(a.Summary) == normalizeActionItem(b.Summary) && sameActionItems(a.ActionItems, b.ActionItems)
+}
+
+func sameActionItems(a, b []ActionItem) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	keys := func(items []ActionItem) []string {
+		keys := make([]string, len(items))
+		for i, item := range items {
+			keys[i] = normalizeActionItem(item.Task) + "|" + item.Due
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	keysA, keysB := keys(a), keys(b)
+	for i := range keysA {
+		if keysA[i] != keysB[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Read a row back from Notion: its summary and its action items. These come from
+// the Action Items column when it was edited in the table view, and otherwise
+// from the to-do blocks left on the page, checked or not. Returns false when the
+// row was deleted.
+func readCorrectedOutput(integrationSecret string, record FeedbackRecord) (EmailAnalysis, bool, error) {
+	body, err := doNotionRequest(integrationSecret, "GET", "pages/"+record.PageID, nil)
+	if err != nil {
+		return EmailAnalysis{}, false, err
+	}
+	var page NotionPage
+	if err := json.Unmarshal(body, &page); err != nil {
+		return EmailAnalysis{}, false, err
+	}
+	if page.Archived {
+		return EmailAnalysis{}, false, nil
+	}
+
+	output := record.Output
+	output.Summary = propertyText(page.Properties["Summary"])
+	output.ActionItems = []ActionItem{}
+	if column := parseActionItemsText(propertyText(page.Properties["Action Items"])); !sameActionItems(column, record.Output.ActionItems) {
+		output.ActionItems = append(output.ActionItems, column...)
+		return output, true, nil
+	}
+
+	blocks, err := readBlockChildren(integrationSecret, record.PageID)
+	if err != nil {
+		return EmailAnalysis{}, false, err
+	}
+	for _, block := range blocks {
+		if block.Type != "to_do" || block.ToDo == nil {
+			continue
+		}
+		var text strings.Builder
+		for _, richText := range block.ToDo.Text {
+			text.WriteString(richText.PlainText)
+		}
+		output.ActionItems = append(output.ActionItems, parseActionItemsText(text.String())...)
+	}
+	return output, true, nil
+}
+
+// The rows edited since the last sync in the databases of the watched records,
+// found with one query per database. Records whose database is missing from the
+// result, because it could not be queried or the record was written before Jot
+// kept database IDs, are read back regardless.
+func editedPages(integrationSecret string, store *FeedbackStore) map[string]map[string]bool {
+	edited := make(map[string]map[string]bool)
+	if store.LastSync.IsZero() {
+		return edited
+	}
+	filter := map[string]any{
+		"property": "Last Edited",
+		"last_edited_time": map[string]any{
+			"on_or_after": store.LastSync.Add(-feedbackEditMargin).Format(time.RFC3339),
+		},
+	}
+	queried := make(map[string]bool)
+	for _, record := range store.Records {
+		if record.DatabaseID == "" || queried[record.DatabaseID] || time.Since(record.Created) > feedbackWindow {
+			continue
+		}
+		queried[record.DatabaseID] = true
+		pages, err := queryDatabase(integrationSecret, record.DatabaseID, filter)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error finding edited rows, reading them all: %v\n", err)
+			continue
+		}
+		edited[record.DatabaseID] = make(map[string]bool, len(pages))
+		for _, page := range pages {
+			edited[record.DatabaseID][page.ID] = true
+		}
+	}
+	return edited
+}
+
+// Read back the rows written in the last two weeks that were edited since the
+// last sync, and keep those a human has corrected as examples. Older records and
+// deleted rows are dropped.
+func syncFeedback(integrationSecret string) error {
+	store, err := readFeedbackStore()
+	if err != nil {
+		return err
+	}
+	syncStart := time.Now()
+	edited := editedPages(integrationSecret, store)
+
+	examples := make(map[string]int)
+	for i, example := range store.Examples {
+		examples[example.PageID] = i
+	}
+
+	var kept []FeedbackRecord
+	corrected := 0
+	readErrors := false
+	for _, record := range store.Records {
+		if time.Since(record.Created) > feedbackWindow {
+			continue
+		}
+		if pages, ok := edited[record.DatabaseID]; ok && !pages[record.PageID] {
+			kept = append(kept, record)
+			continue
+		}
+		output, exists, err := readCorrectedOutput(integrationSecret, record)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading feedback for %q: %v\n", record.Subject, err)
+			readErrors = true
+			kept = append(kept, record)
+			continue
+		}
+		if !exists {
+			continue
+		}
+		kept = append(kept, record)
+		if sameOutput(output, record.Output) {
+			continue
+		}
+
+		example := FeedbackExample{
+			PageID:    record.PageID,
+			Sender:    record.Sender,
+			Subject:   record.Subject,
+			Text:      record.Text,
+			Output:    output,
+			Corrected: time.Now(),
+		}
+		if i, ok := examples[record.PageID]; ok {
+			if sameOutput(store.Examples[i].Output, output) {
+				continue
+			}
+			store.Examples[i] = example
+		} else {
+			examples[record.PageID] = len(store.Examples)
+			store.Examples = append(store.Examples, example)
+		}
+		corrected++
+	}
+	store.Records = kept
+	if !readErrors {
+		// Otherwise the rows that could not be read are looked at again next time
+		store.LastSync = syncStart
+	}
+
+	if err := store.save(); err != nil {
+		return fmt.Errorf("error saving feedback: %v", err)
+	}
+	fmt.Printf("Feedback synced, %d new corrections, %d examples in total\n", corrected, len(store.Examples))
+	return nil
+}
+
+// Warn when the pinned action_items template has no place for the examples.
+func checkExamplesTemplate() {
+	template := getPromptTemplate("action_items")
+	if !strings.Contains(template.System+template.User, ".Examples") {
+		fmt.Printf("The action_items template %s does not use {{.Examples}}, corrections are collected but not shown to the model. Use v4 or later.\n", template.Version)
+	}
+}
+
+var (
+	feedbackExamples     []FeedbackExample
+	feedbackExamplesOnce sync.Once
+)
+
+func getFeedbackExamples() []FeedbackExample {
+	feedbackExamplesOnce.Do(func() {
+		store, err := readFeedbackStore()
+		if err != nil {
+			fmt.Println("Unable to read feedback examples: ", err)
+			return
+		}
+		feedbackExamples = store.Examples
+	})
+	return feedbackExamples
+}
+
+// The domain of an address, "" when it has none.
+func addressDomain(address string) string {
+	if i := strings.LastIndex(address, "@"); i != -1 {
+		return address[i+1:]
+	}
+	return ""
+}
+
+// The corrected examples most relevant to an email: same sender first, then the
+// same domain, then those whose subject shares the most words.
+func relevantExamples(email Email, limit int) []FeedbackExample {
+	sender := ""
+	if email.sender != nil {
+		sender = strings.ToLower(email.sender.Address)
+	}
+
+	type scored struct {
+		example FeedbackExample
+		score   float64
+	}
+	var candidates []scored
+	for _, example := range getFeedbackExamples() {
+		score := actionItemSimilarity(example.Subject, email.subject)
+		switch {
+		case sender != "" && example.Sender == sender:
+			score += 2
+		case sender != "" && addressDomain(example.Sender) == addressDomain(sender) && addressDomain(sender) != "":
+			score += 1
+		}
+		if score > 0 {
+			candidates = append(candidates, scored{example, score})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score > candidates[j].score
+		}
+		return candidates[i].example.Corrected.After(candidates[j].example.Corrected)
+	})
+
+	var examples []FeedbackExample
+	for i := 0; i < len(candidates) && i < limit; i++ {
+		examples = append(examples, candidates[i].example)
+	}
+	return examples
+}
+
+// The few-shot examples for an email's analysis prompt, "" when feedback is off
+// or nothing relevant has been corrected.
+func formatExamplesForPrompt(email Email) string {
+	config := getConfiguration()
+	if !config.Feedback {
+		return ""
+	}
+	limit := config.FewShotExamples
+	if limit == 0 {
+		limit = defaultFewShotExamples
+	}
+	if limit < 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	for i, example := range relevantExamples(email, limit) {
+		// The fields of the output format, without nulls the model might copy
+		output := struct {
+			Summary     string       `json:"summary"`
+			ActionItems []ActionItem `json:"action_items"`
+			Categories  []string     `json:"categories"`
+			NeedsReply  bool         `json:"needs_reply"`
+			KeyDates    []KeyDate    `json:"key_dates"`
+		}{example.Output.Summary, example.Output.ActionItems, example.Output.Categories, example.Output.NeedsReply, example.Output.KeyDates}
+		if output.ActionItems == nil {
+			output.ActionItems = []ActionItem{}
+		}
+		if output.Categories == nil {
+			output.Categories = []string{}
+		}
+		if output.KeyDates == nil {
+			output.KeyDates = []KeyDate{}
+		}
+		data, err := json.Marshal(output)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&sb, "Example %d:\n%s\nOutput: %s\n\n", i+1, example.Text, data)
+	}
+	return strings.TrimSpace(sb.String())
+}
@@ -7,7 +7,10 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"mime"
 	"net/http"
+	"net/mail"
+	"net/textproto"
 	"net/url"
 	"os"
 	"regexp"
@@ -16,6 +19,7 @@ import (
 	"time"
 
 	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/gmail/v1"
@@ -23,20 +27,68 @@ import (
 )
 
 type Email struct {
-	from    string
-	to      string
-	subject string
-	body    []string
-	date    string
-	summary string
+	from       string
+	to         string
+	subject    string
+	body       []string
+	date       string
+	summary    string
+	sender     *mail.Address
+	recipients []*mail.Address
+	cc         []*mail.Address
+	replyTo    []*mail.Address
+	messageID  string
+	inReplyTo  string
+	references []string
+	listID     string
+	id         string
+	threadID   string
+	account    string
+	// Address of the mailbox owner, to tell whether they were in To or Cc
+	userAddress string
+	received    time.Time
+	labels      []string
+	// Sent by the user and processed for commitments rather than action items
+	sent           bool
+	commitments    []Commitment
+	draftLink      string
+	priority       string
+	priorityReason string
+	// The provider and model the summary came from, several when parts of the
+	// email fell back to different models
+	model       string
+	actionItems []ActionItem
+	categories  []string
+	needsReply  bool
+	keyDates    []KeyDate
+	entities    Entities
+	// The email's vectors for the search index, nil when it is not indexed
+	indexEntry *IndexEntry
+	// Authentication-Results added by Gmail and the links of the HTML body,
+	// checked for phishing along with the sender
+	authResults     string
+	links           []EmailLink
+	suspicious      bool
+	phishingReasons []string
+	// The HTML body, for the selectors of email parsers
+	html string
+	// The email parser that analyzed the email instead of the LLM, if any
+	parser string
+	// Why no part of the email could be analyzed, shown on its row
+	analysisError string
+	// The urgency the analysis gave the email, 0 when it gave none
+	urgency       int
+	urgencyReason string
 }
 
+// Decodes RFC 2047 encoded words, including charsets other than UTF-8 and ISO-8859-1.
+var headerDecoder = &mime.WordDecoder{CharsetReader: charset.NewReaderLabel}
+
 // Retrieve a token, saves the token, then returns the generated client.
-func getClient(config *oauth2.Config) *http.Client {
+func getClient(config *oauth2.Config, tokFile string) *http.Client {
 	// The file token.json stores the user's access and refresh tokens, and is
 	// created automatically when the authorization flow completes for the first
 	// time.
-	tokFile := "token.json"
 	tok, err := tokenFromFile(tokFile)
 	if err != nil {
 		tok = getTokenFromWeb(config)
@@ -170,17 +222,168 @@ func getMessageContent(msg *gmail.Message) (string, map[string]string, error) {
 
 	headers := make(map[string]string)
 	for _, header := range msg.Payload.Headers {
-		switch header.Name {
+		// Header casing varies between senders (Message-ID, Message-Id, CC, ...)
+		name := textproto.CanonicalMIMEHeaderKey(header.Name)
+		switch name {
 		case "From",
 			"To",
+			"Cc",
+			"Reply-To",
 			"Subject",
-			"Date":
-			headers[header.Name] = header.Value
+			"Date",
+			"Message-Id",
+			"In-Reply-To",
+			"References",
+			"List-Id":
+			headers[name] = header.Value
+		case "Authentication-Results":
+			// The topmost is Gmail's own, those below it could have been added by the sender
+			if _, ok := headers[name]; !ok {
+				headers[name] = header.Value
+			}
 		}
 	}
 	return html, headers, nil
 }
 
+// Decode any RFC 2047 encoded words in a header value.
+func decodeHeader(value string) string {
+	decoded, err := headerDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// Parse an address header into display names and email addresses.
+// Malformed headers fall back to picking out anything that looks like an address.
+func parseAddressList(value string) []*mail.Address {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+
+	parser := mail.AddressParser{WordDecoder: headerDecoder}
+	addresses, err := parser.ParseList(value)
+	if err == nil {
+		return addresses
+	}
+
+	var fallback []*mail.Address
+	for _, part := range strings.Split(decodeHeader(value), ",") {
+		match := looseAddressRegex.FindString(part)
+		if match == "" {
+			continue
+		}
+		name := strings.TrimSpace(strings.Replace(part, match, "", 1))
+		name = strings.Trim(name, ` "<>`)
+		fallback = append(fallback, &mail.Address{Name: name, Address: match})
+	}
+	return fallback
+}
+
+var looseAddressRegex = regexp.MustCompile(`[^\s<>"',;]+@[^\s<>"',;]+`)
+
+// Parse a header holding a single address, such as From.
+func parseAddress(value string) *mail.Address {
+	addresses := parseAddressList(value)
+	if len(addresses) == 0 {
+		return nil
+	}
+	return addresses[0]
+}
+
+// Format an address for display, preferring "Name <email>" when a name is present.
+func formatAddress(address *mail.Address) string {
+	if address == nil {
+		return ""
+	}
+	if address.Name == "" {
+		return address.Address
+	}
+	return fmt.Sprintf("%s <%s>", address.Name, address.Address)
+}
+
+// Split a message id list header such as References into individual ids.
+func parseMessageIDs(value string) []string {
+	var ids []string
+	for _, field := range strings.Fields(value) {
+		ids = append(ids, strings.TrimSpace(field))
+	}
+	return ids
+}
+
+// Build an Email from the headers returned by getMessageContent.
+func newEmailFromHeaders(headers map[string]string) Email {
+	sender := parseAddress(headers["From"])
+	from := decodeHeader(headers["From"])
+	if sender != nil {
+		from = formatAddress(sender)
+	}
+
+	return Email{
+		from:        from,
+		to:          decodeHeader(headers["To"]),
+		subject:     decodeHeader(headers["Subject"]),
+		sender:      sender,
+		recipients:  parseAddressList(headers["To"]),
+		cc:          parseAddressList(headers["Cc"]),
+		replyTo:     parseAddressList(headers["Reply-To"]),
+		messageID:   strings.TrimSpace(headers["Message-Id"]),
+		inReplyTo:   strings.TrimSpace(headers["In-Reply-To"]),
+		references:  parseMessageIDs(headers["References"]),
+		listID:      decodeHeader(headers["List-Id"]),
+		authResults: headers["Authentication-Results"],
+	}
+}
+
+func hasLabel(email Email, label string) bool {
+	for _, l := range email.labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+// The address of the authenticated user, or "" if the profile cannot be read.
+func getUserAddress(client *gmail.Service, user string) string {
+	profile, err := client.Users.GetProfile(user).Do()
+	if err != nil {
+		fmt.Println("Unable to retrieve profile: ", err)
+		return ""
+	}
+	return profile.EmailAddress
+}
+
+// Work out which account links back to Gmail should open in.
+func getAccount(userAddress string) string {
+	if account := getConfiguration().GmailAccount; account != "" {
+		return account
+	}
+	if userAddress == "" {
+		return "0"
+	}
+	return userAddress
+}
+
+// Link to the message in the Gmail web client. Messages that did not come from the
+// Gmail API (e.g. IMAP) only have a Message-ID, so they get an RFC 2392 mid: link.
+func messageLink(email Email) string {
+	if email.id != "" {
+		account := email.account
+		if account == "" {
+			account = "0"
+		}
+		return fmt.Sprintf("https://mail.google.com/mail/u/%s/#all/%s", url.PathEscape(account), email.id)
+	}
+
+	messageID := strings.Trim(strings.TrimSpace(email.messageID), "<>")
+	if messageID == "" {
+		return ""
+	}
+	return "mid:" + url.PathEscape(messageID)
+}
+
 // FetchLatestMessage retrieves the latest message in the inbox of the given user.
 // If no messages are found, an error is returned.
 func FetchLatestMessage(client *gmail.Service, user string) (*gmail.Message, error) {
@@ -278,27 +481,40 @@ func readStartHistoryIdFromConfig(fileName string, client *gmail.Service, user s
 }
 
 // GetMessagesAddedinHistory retrieves the list of messages added in the history after the given history id.
-// The function returns a slice of message IDs and the latest history id.
+// The function returns a slice of message IDs and the latest history id. Every page
+// of the history is read, and nothing is returned when any of them fails.
 func GetMessagesAddedinHistory(history_id uint64, client *gmail.Service, user string) ([]string, uint64, error) {
-	// Retrieve the history of the user.
-	history, err := client.Users.History.List(user).StartHistoryId(history_id).Do()
-	if err != nil {
-		fmt.Println("unable to retrieve history: ", err)
-		return nil, 0, fmt.Errorf("unable to retrieve history: %v", err)
-	}
-
 	// Initialize a slice to store the new message IDs.
 	new_messages := []string{}
+	var latest_history_id uint64
+
+	pageToken := ""
+	for {
+		// Retrieve the next page of the history of the user.
+		call := client.Users.History.List(user).StartHistoryId(history_id)
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		history, err := call.Do()
+		if err != nil {
+			return nil, 0, fmt.Errorf("unable to retrieve history: %v", err)
+		}
 
-	// Update the latest history ID.
-	latest_history_id := history.HistoryId
+		// Update the latest history ID.
+		latest_history_id = history.HistoryId
 
-	// Iterate through the history and extract the message IDs.
-	for _, hist := range history.History {
-		message_added := hist.MessagesAdded
-		for _, msg := range message_added {
-			new_messages = append(new_messages, msg.Message.Id)
+		// Iterate through the history and extract the message IDs.
+		for _, hist := range history.History {
+			message_added := hist.MessagesAdded
+			for _, msg := range message_added {
+				new_messages = append(new_messages, msg.Message.Id)
+			}
 		}
+
+		if history.NextPageToken == "" {
+			break
+		}
+		pageToken = history.NextPageToken
 	}
 
 	return new_messages, latest_history_id, nil
@@ -333,57 +549,24 @@ func getAllTextFromHTML(htmlContent string) ([]string, error) {
 	return textPortions, nil
 }
 
-func removeParenthesizedText(input string) string {
-	re := regexp.MustCompile(`\s*\(.*?\)\s*`)
-	return re.ReplaceAllString(input, "")
-}
-
-func formatDate(inputDate string) string {
-	// Define a list of possible date formats
-	dateFormats := []string{
-		time.RFC1123Z,                    // "Mon, 02 Jan 2006 15:04:05 -0700"
-		time.RFC1123,                     // "Mon, 02 Jan 2006 15:04:05 MST"
-		time.RFC3339,                     // "2006-01-02T15:04:05Z07:00"
-		"Mon, 2 Jan 2006 15:04:05 -0700", // Custom layout to handle one-digit day
-	}
-
-	// Remove parenthesized text from the input date
-	cleanedInputDate := removeParenthesizedText(inputDate)
-
-	var parsedTime time.Time
-	var err error
-
-	// Try parsing the date with each format
-	for _, layout := range dateFormats {
-		parsedTime, err = time.Parse(layout, cleanedInputDate)
-		if err == nil {
-			break
-		}
-	}
-
-	if err != nil {
-		fmt.Println("Error parsing date:", err)
-		return ""
-	}
-
-	// Define the layout for the output date format
-	outputLayout := time.RFC3339
-
-	// Format the parsed time to UTC and then to the desired output format
-	outputDate := parsedTime.UTC().Format(outputLayout)
-
-	return outputDate
-}
-
-func parseEmails(messages []string, client *gmail.Service, user string) ([]Email, error) {
+// Fetch and parse the given messages. Messages that cannot be retrieved because
+// of a transient error are returned separately so they can be retried on the next
+// run, the others are skipped.
+func parseEmails(messages []string, client *gmail.Service, user string, account string) ([]Email, []string, error) {
 	var newEmails []Email
+	var failed []string
 
 	for _, message := range messages {
 		// Get the message content
 		fmt.Println("Getting message : ", message)
 		msg, err := client.Users.Messages.Get(user, message).Do()
 		if err != nil {
-			fmt.Printf("Unable to retrieve %v: %v", message, err)
+			if !isTransientGmailError(err) {
+				fmt.Printf("Unable to retrieve %v, skipping it: %v\n", message, err)
+				continue
+			}
+			fmt.Printf("Unable to retrieve %v, will retry on the next run: %v\n", message, err)
+			failed = append(failed, message)
 			continue
 		}
 
@@ -397,62 +580,117 @@ func parseEmails(messages []string, client *gmail.Service, user string) ([]Email
 		if err != nil {
 			log.Fatalf("Unable to get text: %v", err)
 		}
-		outputDate := formatDate(headers["Date"])
-		newEmails = append(newEmails, Email{headers["From"], headers["To"], headers["Subject"], content, outputDate, ""})
-	}
-
-	return newEmails, nil
+		email := newEmailFromHeaders(headers)
+		email.body = content
+		email.html = html
+		email.links = extractLinks(html)
+		email.id = msg.Id
+		email.threadID = msg.ThreadId
+		email.account = account
+		email.received = parseEmailDate(headers["Date"], msg.InternalDate)
+		email.date = formatDate(email.received)
+		email.labels = msg.LabelIds
+		email.sent = getConfiguration().ProcessSent && hasLabel(email, "SENT")
+		newEmails = append(newEmails, email)
+	}
+
+	return newEmails, failed, nil
 }
 
-func getEmails(emailChnl chan<- Email, wg *sync.WaitGroup) []Email {
+// Authorize with Gmail and build the service shared by every stage of a run.
+func getGmailService() (*gmail.Service, *retryTransport) {
 	ctx := context.Background()
-	defer wg.Done()
 	b, err := os.ReadFile("credentials.json")
 	if err != nil {
 		log.Fatalf("Unable to read client secret file: %v", err)
 	}
 
 	// If modifying these scopes, delete your previously saved token.json.
-	config, err := google.ConfigFromJSON(b, gmail.GmailReadonlyScope)
+	// Drafting replies needs the compose scope, which is kept in its own token
+	// file so turning it on or off does not leave a token with the wrong scopes.
+	scopes := []string{gmail.GmailReadonlyScope}
+	tokFile := "token.json"
+	if getConfiguration().DraftReplies {
+		scopes = append(scopes, gmail.GmailComposeScope)
+		tokFile = "token-compose.json"
+	}
+	config, err := google.ConfigFromJSON(b, scopes...)
 	if err != nil {
 		log.Fatalf("Unable to parse client secret file to config: %v", err)
 	}
-	client := getClient(config)
+	client := getClient(config, tokFile)
+	transport := newRetryTransport(client.Transport)
+	client.Transport = transport
 
 	srv, err := gmail.NewService(ctx, option.WithHTTPClient(client))
 	if err != nil {
 		log.Fatalf("Unable to retrieve Gmail client: %v", err)
 	}
+	return srv, transport
+}
 
-	user := "me"
-
+// The IDs of the messages added since the saved start history ID, which is moved
+// on to the latest history ID. When the history cannot be read the saved ID is
+// kept, so the next run fetches the same messages again.
+func getNewMessageIDs(srv *gmail.Service, user string) ([]string, error) {
 	start_history_id, err := GetStartHistoryId(srv, user)
 	if err != nil {
-		log.Fatalf("Unable to retrieve startHistoryId: %v", err)
+		return nil, fmt.Errorf("unable to retrieve startHistoryId: %v", err)
 	}
 
 	fmt.Println("Fetching history for ", start_history_id)
 
 	new_messages, latest_history_id, err := GetMessagesAddedinHistory(start_history_id, srv, user)
 	if err != nil {
-		log.Fatalf("Unable to get messages: %v", err)
+		return nil, err
 	}
 
 	err = saveStartHistoryIdToConfig(latest_history_id, "config.json")
 	if err != nil {
-		log.Fatalf("Unable to save startHistoryId to config: %v", err)
+		return nil, fmt.Errorf("unable to save startHistoryId to config: %v", err)
+	}
+	return new_messages, nil
+}
+
+func getEmails(srv *gmail.Service, transport *retryTransport, emailChnl chan<- Email, wg *sync.WaitGroup) []Email {
+	defer wg.Done()
+	defer close(emailChnl)
+
+	user := "me"
+
+	new_messages, err := getNewMessageIDs(srv, user)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to get new messages, they will be fetched next run: %v\n", err)
 	}
 
-	emails, err := parseEmails(new_messages, srv, user)
+	// Retry the messages that could not be fetched last time
+	previouslyFailed, err := readFailedMessages()
+	if err != nil {
+		fmt.Println("Unable to read failed messages: ", err)
+	}
+	new_messages = mergeMessageIDs(new_messages, previouslyFailed)
+
+	userAddress := getUserAddress(srv, user)
+	account := getAccount(userAddress)
+
+	emails, failed, err := parseEmails(new_messages, srv, user, account)
 	if err != nil {
 		log.Fatalf("Unable to parse emails: %v", err)
 	}
 
+	for i := range emails {
+		emails[i].userAddress = userAddress
+	}
+
+	if err := saveFailedMessages(failed); err != nil {
+		fmt.Println("Unable to save failed messages: ", err)
+	}
+	printQuotaUsage(transport)
+
 	fmt.Printf("You have %d new Messages", len(emails))
 
 	for _, email := range emails {
 		emailChnl <- email
 	}
-	close(emailChnl)
 	return emails
 }
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	failedMessagesFileName = "failedMessages.json"
+
+	defaultGmailMaxRetries = 5
+	gmailBaseDelay         = 500 * time.Millisecond
+	gmailMaxDelay          = 32 * time.Second
+
+	// Gmail allows 250 quota units per user per second
+	defaultGmailQuotaPerSecond = 250
+
+	breakerFailureThreshold = 5
+	breakerCooldown         = 30 * time.Second
+)
+
+var errCircuitOpen = errors.New("gmail circuit breaker is open, too many consecutive failures")
+
+// Quota units charged by the Gmail API for the methods Jot calls.
+// See https://developers.google.com/gmail/api/reference/quota
+func gmailQuotaUnits(req *http.Request) int {
+	path := req.URL.Path
+	switch {
+	case strings.HasSuffix(path, "/history"):
+		return 2
+	case strings.HasSuffix(path, "/profile"), strings.Contains(path, "/labels"):
+		return 1
+	case strings.Contains(path, "/drafts") && req.Method == http.MethodPost:
+		return 10
+	default:
+		// messages.list and messages.get
+		return 5
+	}
+}
+
+// Tracks the quota units spent per user over a sliding one second window and
+// makes callers wait when the next request would go over the limit.
+type quotaMeter struct {
+	mu        sync.Mutex
+	perSecond int
+	spent     []quotaSpend
+	total     map[string]int
+}
+
+type quotaSpend struct {
+	at    time.Time
+	units int
+}
+
+func newQuotaMeter(perSecond int) *quotaMeter {
+	return &quotaMeter{perSecond: perSecond, total: make(map[string]int)}
+}
+
+func (q *quotaMeter) wait(user string, units int) {
+	for {
+		q.mu.Lock()
+		now := time.Now()
+		windowStart := now.Add(-time.Second)
+		for len(q.spent) > 0 && q.spent[0].at.Before(windowStart) {
+			q.spent = q.spent[1:]
+		}
+
+		used := 0
+		for _, s := range q.spent {
+			used += s.units
+		}
+
+		if used+units <= q.perSecond || len(q.spent) == 0 {
+			q.spent = append(q.spent, quotaSpend{now, units})
+			q.total[user] += units
+			q.mu.Unlock()
+			return
+		}
+
+		sleep := q.spent[0].at.Sub(windowStart)
+		q.mu.Unlock()
+		time.Sleep(sleep)
+	}
+}
+
+// Total quota units spent by each user.
+func (q *quotaMeter) totals() map[string]int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	totals := make(map[string]int, len(q.total))
+	for user, units := range q.total {
+		totals[user] = units
+	}
+	return totals
+}
+
+// Stops calling Gmail for a cooldown period after too many consecutive failures,
+// then lets a single request through to check whether it has recovered.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < breakerFailureThreshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) {
+		return false
+	}
+	// Half open, allow one trial request and re-open straight away if it fails
+	b.failures = breakerFailureThreshold - 1
+	return true
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	b.failures = 0
+	b.mu.Unlock()
+}
+
+func (b *circuitBreaker) failure() {
+	b.mu.Lock()
+	b.failures++
+	if b.failures >= breakerFailureThreshold {
+		b.openUntil = time.Now().Add(breakerCooldown)
+	}
+	b.mu.Unlock()
+}
+
+// An http.RoundTripper that retries transient Gmail errors with jittered
+// exponential backoff, keeps requests within the per-user quota and trips a
+// circuit breaker when Gmail keeps failing.
+type retryTransport struct {
+	base       http.RoundTripper
+	maxRetries int
+	quota      *quotaMeter
+	breaker    *circuitBreaker
+}
+
+func newRetryTransport(base http.RoundTripper) *retryTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	config := getConfiguration()
+	maxRetries := config.GmailMaxRetries
+	if maxRetries <= 0 {
+		maxRetries = defaultGmailMaxRetries
+	}
+	perSecond := config.GmailQuotaPerSecond
+	if perSecond <= 0 {
+		perSecond = defaultGmailQuotaPerSecond
+	}
+
+	return &retryTransport{
+		base:       base,
+		maxRetries: maxRetries,
+		quota:      newQuotaMeter(perSecond),
+		breaker:    &circuitBreaker{},
+	}
+}
+
+// The user a Gmail API request is made for, taken from /gmail/v1/users/{user}/...
+func gmailRequestUser(req *http.Request) string {
+	parts := strings.Split(req.URL.Path, "/")
+	for i, part := range parts {
+		if part == "users" && i+1 < len(parts) {
+			return parts[i+1]
+		}
+	}
+	return "me"
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.breaker.allow() {
+		return nil, errCircuitOpen
+	}
+
+	// Requests with a body can only be retried if the body can be read again
+	canRetry := req.Body == nil || req.GetBody != nil
+
+	var resp *http.Response
+	var err error
+	for attempt := 0; ; attempt++ {
+		attemptReq := req
+		if attempt > 0 && req.Body != nil {
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return nil, bodyErr
+			}
+			attemptReq = req.Clone(req.Context())
+			attemptReq.Body = body
+		}
+
+		t.quota.wait(gmailRequestUser(req), gmailQuotaUnits(req))
+		resp, err = t.base.RoundTrip(attemptReq)
+
+		retry, retryAfter := shouldRetry(resp, err)
+		if !retry {
+			break
+		}
+		if !canRetry || attempt >= t.maxRetries {
+			break
+		}
+
+		delay := backoffDelay(attempt)
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(delay):
+		}
+	}
+
+	if err != nil || resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		t.breaker.failure()
+	} else {
+		t.breaker.success()
+	}
+	return resp, err
+}
+
+// Exponential backoff with full jitter.
+func backoffDelay(attempt int) time.Duration {
+	delay := gmailBaseDelay << attempt
+	if delay <= 0 || delay > gmailMaxDelay {
+		delay = gmailMaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(delay))) + gmailBaseDelay/2
+}
+
+// Decide whether a response is a transient failure worth retrying, along with
+// any delay Gmail asked for in Retry-After.
+func shouldRetry(resp *http.Response, err error) (bool, time.Duration) {
+	if err != nil {
+		// Network errors such as resets and timeouts are transient
+		return true, 0
+	}
+
+	retryAfter := time.Duration(0)
+	if seconds, convErr := strconv.Atoi(resp.Header.Get("Retry-After")); convErr == nil {
+		retryAfter = time.Duration(seconds) * time.Second
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true, retryAfter
+	case http.StatusForbidden:
+		// Gmail reports rate limits as 403s with a rateLimitExceeded reason,
+		// other 403s are permission problems that will not go away on retry
+		body, readErr := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		if readErr != nil {
+			return false, 0
+		}
+		return bytes.Contains(body, []byte("rateLimitExceeded")) ||
+			bytes.Contains(body, []byte("userRateLimitExceeded")), retryAfter
+	}
+	return false, 0
+}
+
+// Whether a failed request may succeed on a later run: Gmail errors, rate limits,
+// network failures and the circuit breaker being open. Messages that were deleted
+// or cannot be read are not worth retrying.
+func isTransientGmailError(err error) bool {
+	if errors.Is(err, errCircuitOpen) {
+		return true
+	}
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return true
+	}
+	if apiErr.Code >= 500 || apiErr.Code == http.StatusTooManyRequests {
+		return true
+	}
+	for _, item := range apiErr.Errors {
+		if item.Reason == "rateLimitExceeded" || item.Reason == "userRateLimitExceeded" {
+			return true
+		}
+	}
+	return false
+}
+
+// Read the IDs of messages that could not be fetched on previous runs.
+func readFailedMessages() ([]string, error) {
+	data, err := os.ReadFile(failedMessagesFileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var failed []string
+	if err := json.Unmarshal(data, &failed); err != nil {
+		return nil, err
+	}
+	return failed, nil
+}
+
+// Save the IDs of messages that could not be fetched so the next run retries them.
+func saveFailedMessages(failed []string) error {
+	if len(failed) == 0 {
+		err := os.Remove(failedMessagesFileName)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.MarshalIndent(failed, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(failedMessagesFileName, data, 0644)
+}
+
+// Add the previously failed message IDs to the new ones, without duplicates.
+func mergeMessageIDs(messages []string, failed []string) []string {
+	seen := make(map[string]bool)
+	var merged []string
+	for _, id := range append(failed, messages...) {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		merged = append(merged, id)
+	}
+	return merged
+}
+
+func printQuotaUsage(transport *retryTransport) {
+	for user, units := range transport.quota.totals() {
+		fmt.Printf("Gmail quota used for %s: %d units\n", user, units)
+	}
+}
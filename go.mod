@@ -9,6 +9,7 @@ require (
 )
 
 require (
+	github.com/pkoukk/tiktoken-go v0.1.2
 	golang.org/x/net v0.20.0
 	golang.org/x/oauth2 v0.10.0
 	google.golang.org/api v0.126.0
@@ -31,7 +32,6 @@ require (
 	github.com/imdario/mergo v0.3.11 // indirect
 	github.com/mitchellh/copystructure v1.0.0 // indirect
 	github.com/mitchellh/reflectwalk v1.0.0 // indirect
-	github.com/pkoukk/tiktoken-go v0.1.2 // indirect
 	github.com/shopspring/decimal v1.2.0 // indirect
 	github.com/spf13/cast v1.3.1 // indirect
 	go.opencensus.io v0.24.0 // indirect
@@ -1,137 +1,418 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/tmc/langchaingo/llms"
-	"github.com/tmc/langchaingo/llms/huggingface"
-	"github.com/tmc/langchaingo/prompts"
+	"google.golang.org/api/gmail/v1"
 )
 
+const settingsFileName = "settings.json"
+
 type Configuration struct {
 	HuggingFace_AccessToken string
 	Google_AccessToken      string
 	Gmail_AccessToken       string
+
+	// Account used in links back to Gmail, either the index shown in the Gmail
+	// URL (0, 1, ...) or the account's address. Defaults to the address of the
+	// authenticated user so links open in the right mailbox.
+	GmailAccount string `json:"gmailAccount"`
+
+	// IANA timezone, e.g. "America/Los_Angeles", used to display dates and to
+	// decide which day's database an email belongs to. Defaults to the local timezone.
+	Timezone string `json:"timezone"`
+
+	// Token budget for the email text in a single prompt. Longer emails are split
+	// into chunks of this size overlapping by ChunkOverlapTokens, at most MaxChunks.
+	ChunkTokens        int `json:"chunkTokens"`
+	ChunkOverlapTokens int `json:"chunkOverlapTokens"`
+	MaxChunks          int `json:"maxChunks"`
+
+	// Retries for transient Gmail errors and the per-user quota units per second
+	GmailMaxRetries     int `json:"gmailMaxRetries"`
+	GmailQuotaPerSecond int `json:"gmailQuotaPerSecond"`
+
+	// Extract the commitments made and replies awaited in sent mail, instead of
+	// summarizing sent messages like received ones.
+	ProcessSent bool `json:"processSent"`
+
+	// Save suggested replies as Gmail drafts for emails that ask the user
+	// something. Needs the gmail.compose scope, so Jot asks to authorize again.
+	DraftReplies bool `json:"draftReplies"`
+
+	// Senders whose emails get a higher priority, as full addresses or as
+	// domains written "@example.com".
+	VIPSenders []string `json:"vipSenders"`
+
+	// The model to summarize with and the chat format its prompts are written in
+	// (mistral, llama3, chatml or plain), guessed from the model name if unset.
+	Model      string `json:"model"`
+	ChatFormat string `json:"chatFormat"`
+
+	// Your name as used in the prompts, and prompt template versions to use
+	// instead of the newest, e.g. {"action_items": "v3"}.
+	UserName       string            `json:"userName"`
+	PromptVersions map[string]string `json:"promptVersions"`
+
+	// Categories emails are tagged with in the Categories property
+	Categories []Category `json:"categories"`
+
+	// How long parsed LLM results are cached, as a Go duration such as "720h", and
+	// the most entries and bytes the cache may hold.
+	CacheTTL        string `json:"cacheTTL"`
+	CacheMaxEntries int    `json:"cacheMaxEntries"`
+	CacheMaxBytes   int64  `json:"cacheMaxBytes"`
+
+	// LLM provider (huggingface, ollama or openai), the number of emails
+	// summarized at once and each provider's request limits.
+	Provider   string               `json:"provider"`
+	OllamaURL  string               `json:"ollamaURL"`
+	Workers    int                  `json:"workers"`
+	RateLimits map[string]RateLimit `json:"rateLimits"`
+
+	// Models tried in order when the configured one fails, times out or gives an
+	// answer that cannot be parsed, and how long to wait for each answer.
+	Fallbacks  []LLMBackend `json:"fallbacks"`
+	LLMTimeout string       `json:"llmTimeout"`
+	// The longest answer requested from a model, in tokens
+	MaxOutputTokens int `json:"maxOutputTokens"`
+
+	// Write a digest page for each day that got new email at the end of a run
+	Digest bool `json:"digest"`
+
+	// Mask PII in prompts with placeholders, using the named built in detectors
+	// (all when empty) and custom patterns, and log what was masked.
+	Redact          bool              `json:"redact"`
+	RedactDetectors []string          `json:"redactDetectors"`
+	RedactPatterns  map[string]string `json:"redactPatterns"`
+	RedactAuditLog  string            `json:"redactAuditLog"`
+
+	// Keep a local index of email vectors for jot search, made with the
+	// embedding provider and model (the LLM provider and its default model when unset).
+	SearchIndex       bool   `json:"searchIndex"`
+	EmbeddingProvider string `json:"embeddingProvider"`
+	EmbeddingModel    string `json:"embeddingModel"`
+
+	// Learn from rows corrected in Notion, showing up to FewShotExamples of
+	// them in the analysis prompt.
+	Feedback        bool `json:"feedback"`
+	FewShotExamples int  `json:"fewShotExamples"`
+
+	// Dollars per million prompt and completion tokens, keyed by "provider/model",
+	// model or provider, and the most to spend a day before summarizing pauses.
+	Prices      map[string]ModelPrice `json:"prices"`
+	DailyBudget float64               `json:"dailyBudget"`
+
+	// Flag emails that look like phishing with a warning in Notion and drop their
+	// action items. Sender domains are checked for lookalikes of common brands,
+	// the VIP senders, your own domain and TrustedDomains.
+	PhishingCheck  bool     `json:"phishingCheck"`
+	TrustedDomains []string `json:"trustedDomains"`
+
+	// Rules for emails from known systems, analyzed without the LLM. They are
+	// tried before the built in ones, which can be turned off by name.
+	Parsers         []EmailParser `json:"parsers"`
+	DisabledParsers []string      `json:"disabledParsers"`
 }
 
-func generatePrompt(email string) string {
-	prompt := prompts.NewPromptTemplate(`
-		[INST] Extract action items from the following Paragraph. If there are no action items, summarize the Paragraph. The final result should be presented as a JSON array of strings of action items assigned to a variable named 'ActionItems'. If no action items are present, then the array should contain a single summary string assigned to the same variable.
-
-		The output must be in the following format: "{'ActionItems':[...]}"
-		***********************************************************
-		Paragraph:
-		{{.Email}}?
-		***********************************************************
-		[/INST]`,
-		[]string{"Email"},
-	)
-	result, err := prompt.Format(map[string]any{
-		"Email": email,
-	})
-	if err != nil {
-		fmt.Println("prompt error")
-		log.Fatal(err)
+var (
+	configuration     Configuration
+	configurationOnce sync.Once
+)
+
+// Read settings files in order, each overriding the keys it sets. Missing files are skipped.
+func readConfiguration(files ...string) (Configuration, error) {
+	var config Configuration
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return config, fmt.Errorf("failed to read %s: %v", file, err)
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return config, fmt.Errorf("failed to unmarshal %s: %v", file, err)
+		}
 	}
-	return result
+	return config, nil
 }
 
-func ParseJson(jsonString string) ([]string, error) {
-	type Response struct {
-		ActionItems []string `json:"ActionItems"`
-	}
+// Load the user settings once. A missing settings file leaves everything at its default.
+func getConfiguration() Configuration {
+	configurationOnce.Do(func() {
+		config, err := readConfiguration(settingsFileName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		configuration = config
+	})
+	return configuration
+}
 
-	var response Response
-	err := json.Unmarshal([]byte(jsonString), &response)
-	if err != nil {
-		// fmt.Println("Error parsing JSON: ", err)
-		return []string{}, err
-	}
-	return response.ActionItems, nil
+// Replace the settings for the rest of the run, used to compare configurations.
+func setConfiguration(config Configuration) {
+	configurationOnce.Do(func() {})
+	configuration = config
+
+	// Derive everything that depends on the settings again on next use: the
+	// parsers, the timezone, the clients, embedders and rate limits of the
+	// providers, whose URLs and limits may have changed, and the keyword regexes
+	emailParsersOnce = sync.Once{}
+	emailParsers = nil
+	locationOnce = sync.Once{}
+	location = nil
+	resetLLMClients()
+	resetEmbedders()
+	resetKeywordRegexes()
+}
+
+var (
+	location     *time.Location
+	locationOnce sync.Once
+)
+
+// The timezone dates are grouped and displayed in.
+func userLocation() *time.Location {
+	locationOnce.Do(func() {
+		location = time.Local
+		name := getConfiguration().Timezone
+		if name == "" {
+			return
+		}
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			fmt.Printf("Unknown timezone %q, using local time: %v\n", name, err)
+			return
+		}
+		location = loc
+	})
+	return location
+}
+
+func generatePrompt(email Email, text string) RenderedPrompt {
+	data := emailPromptData(email, text)
+	data["Examples"] = formatExamplesForPrompt(email)
+	return renderPrompt("action_items", data)
 }
 
-func cleanResult(result string) []string {
-	lowerHalf := strings.SplitAfter(result, "[/INST]")
-	ActionItems, _ := ParseJson(lowerHalf[1])
-	return ActionItems
+func generateMergePrompt(email Email, analyses []EmailAnalysis) RenderedPrompt {
+	data := emailPromptData(email, "")
+	data["Parts"] = formatAnalysesForPrompt(analyses)
+	return renderPrompt("merge", data)
 }
 
-func getNewClient() *huggingface.LLM {
-	clientOptions := []huggingface.Option{
-		huggingface.WithToken(os.Getenv("HUGGINGFACEHUB_API_TOKEN")),
-		huggingface.WithModel("mistralai/Mistral-7B-Instruct-v0.1"),
+// Ask the model to analyze an email and validate its answer, returning the
+// model that gave it.
+func extractAnalysis(prompt RenderedPrompt) (EmailAnalysis, string, error) {
+	return completeJSONWithModel(prompt, parseAnalysis)
+}
+
+// The chunk size, overlap and chunk limit from the settings, with defaults filled in.
+func chunkSettings() (int, int, int) {
+	config := getConfiguration()
+	chunkTokens := config.ChunkTokens
+	if chunkTokens <= 0 {
+		chunkTokens = defaultChunkTokens
 	}
-	llm, err := huggingface.New(clientOptions...)
-	if err != nil {
-		fmt.Println("new error")
-		log.Fatal(err)
+	overlapTokens := config.ChunkOverlapTokens
+	if overlapTokens <= 0 || overlapTokens >= chunkTokens {
+		overlapTokens = min(defaultChunkOverlap, chunkTokens/4)
 	}
-	return llm
+	maxChunks := config.MaxChunks
+	if maxChunks <= 0 {
+		maxChunks = defaultMaxChunkCount
+	}
+	return chunkTokens, overlapTokens, maxChunks
 }
 
-func extractActionItems(prompt string) []string {
-	llm := getNewClient()
-	ctx := context.Background()
-	generateOptions := []llms.CallOption{
-		llms.WithModel("mistralai/Mistral-7B-Instruct-v0.1"),
-		llms.WithMinLength(50),
-		llms.WithMaxLength(400),
+// Extract action items from an email, splitting bodies over the token budget into
+// overlapping chunks and merging the items found in each chunk. Also returns the
+// models that answered, or an error when no part could be analyzed.
+func summarizeEmail(email Email, header string) (EmailAnalysis, string, error) {
+	parts := emailParts(email, header)
+
+	var models []string
+	addModel := func(model string) {
+		if model != "" && !slices.Contains(models, model) {
+			models = append(models, model)
+		}
+	}
+
+	var analyses []EmailAnalysis
+	var lastErr error
+	for _, part := range parts {
+		analysis, model, err := extractAnalysis(generatePrompt(email, part))
+		if err != nil {
+			fmt.Println("Error parsing analysis: ", err)
+			lastErr = err
+			continue
+		}
+		addModel(model)
+		analyses = append(analyses, analysis)
+	}
+
+	if len(analyses) <= 1 {
+		if len(analyses) == 0 {
+			return EmailAnalysis{}, "", fmt.Errorf("no part of the email could be analyzed: %v", lastErr)
+		}
+		return analyses[0], strings.Join(models, ", "), nil
 	}
-	completion, err := llm.Call(ctx, prompt, generateOptions...)
-	// Check for errors
+
+	merged, model, err := extractAnalysis(generateMergePrompt(email, analyses))
 	if err != nil {
-		fmt.Println("call error")
-		log.Fatal(err)
+		// The merge output could not be parsed, fall back to combining the parts directly
+		fmt.Println("Error parsing merged analysis: ", err)
+		return mergeAnalyses(analyses), strings.Join(models, ", "), nil
 	}
-	finalResult := cleanResult(completion)
+	addModel(model)
+	return merged, strings.Join(models, ", "), nil
+}
 
-	return finalResult
+// The email text to extract action items from, split into parts that each fit
+// the token budget.
+func emailParts(email Email, header string) []string {
+	chunkTokens, overlapTokens, maxChunks := chunkSettings()
+
+	chunks := splitIntoChunks(email.body, chunkTokens, overlapTokens)
+	if len(chunks) <= 1 {
+		return []string{header + "\n" + strings.Join(chunks, "\n")}
+	}
+	if len(chunks) > maxChunks {
+		fmt.Printf("Email has %d chunks, only the first %d will be summarized\n", len(chunks), maxChunks)
+		chunks = chunks[:maxChunks]
+	}
+
+	parts := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		parts[i] = fmt.Sprintf("%s\n(Part %d of %d)\n%s", header, i+1, len(chunks), chunk)
+	}
+	return parts
 }
 
-func formatSliceToString(slice []string) string {
-	var sb strings.Builder
+// The headers included with the email text in prompts.
+func formatEmailHeader(email Email) string {
+	return "From: " + email.from + "\nTo: " + email.to + "\nSubject: " + email.subject
+}
+
+// Summarize emails with a pool of workers sharing one LLM client. Emails are
+// passed on in the order they finish, and llmChnl is closed once every worker is done.
+func runWorkers(srv *gmail.Service, emailChnl <-chan Email, llmChnl chan<- Email, wg *sync.WaitGroup) {
+	defer wg.Done()
 
-	for i, str := range slice {
-		// Append the formatted string to the StringBuilder
-		sb.WriteString(fmt.Sprintf("%d. %s\n", i+1, str))
+	workers := getConfiguration().Workers
+	if workers <= 0 {
+		workers = defaultWorkers
 	}
 
-	return sb.String()
+	var workersWg sync.WaitGroup
+	workersWg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go process(srv, emailChnl, llmChnl, &workersWg)
+	}
+	workersWg.Wait()
+	close(llmChnl)
 }
 
-func process(emailChnl <-chan Email, llmChnl chan<- Email, wg *sync.WaitGroup) {
+func process(srv *gmail.Service, emailChnl <-chan Email, llmChnl chan<- Email, wg *sync.WaitGroup) {
 	defer wg.Done()
 	for email := range emailChnl {
-		emailString := "From: " + email.from + "\nTo: " + email.to + "\nSubject: " + email.subject
-		for _, content := range email.body {
-			emailString += "\n" + content
+		if overBudget() {
+			pauseMessage(email.id)
+			continue
+		}
+		emailHeader := formatEmailHeader(email)
+		if email.sent {
+			email.commitments = extractCommitments(generateCommitmentsPrompt(email, emailHeader))
+			llmChnl <- email
+			continue
 		}
-		result := generatePrompt(emailString)
-		finalResult := extractActionItems(result)
+		var analysis EmailAnalysis
+		if parsed, parser, ok := parseKnownEmail(email); ok {
+			// A known format, no need to ask the model
+			analysis, email.parser, email.model = parsed, parser, "parser/"+parser
+		} else {
+			var err error
+			analysis, email.model, err = summarizeEmail(email, emailHeader)
+			if err != nil {
+				// Still add the row, marked so it is not mistaken for an email without action items
+				fmt.Println("Error analyzing email: ", err)
+				email.analysisError = err.Error()
+			}
+		}
+		email.summary = analysis.Summary
+		email.actionItems = analysis.ActionItems
+		email.categories = categorize(email, analysis)
+		email.needsReply = analysis.NeedsReply
+		email.keyDates = analysis.KeyDates
+		email.urgency, email.urgencyReason = analysis.Urgency, analysis.UrgencyReason
+		email.entities = extractEntities(email, emailHeader, analysis)
 
-		formattedString := formatSliceToString(finalResult)
+		if getConfiguration().PhishingCheck {
+			email.suspicious, email.phishingReasons = assessPhishing(email, emailHeader)
+			if email.suspicious {
+				// Do not ask the user to act on what may be a phishing attempt
+				email.actionItems = nil
+				email.needsReply = false
+			}
+		}
 
-		email.summary = formattedString
+		if getConfiguration().DraftReplies && email.needsReply {
+			email.draftLink = draftReply(srv, "me", email, emailHeader)
+		}
+		email.priority, email.priorityReason = scorePriority(email, emailHeader)
+
+		if getConfiguration().SearchIndex {
+			entry, err := embedEmail(email)
+			if err != nil {
+				fmt.Println("Error indexing email: ", err)
+			} else {
+				email.indexEntry = &entry
+			}
+		}
 		llmChnl <- email
 	}
-	close(llmChnl)
 }
 
 func main() {
+	flag.BoolVar(&cacheDisabled, "no-cache", false, "ignore cached LLM results and call the model again")
+	flag.Usage = printUsage
+	flag.Parse()
+
+	if flag.NArg() > 0 {
+		runCommand(flag.Args())
+		if err := saveUsage(); err != nil {
+			fmt.Println("Unable to save usage totals: ", err)
+		}
+		return
+	}
+
 	var wg sync.WaitGroup
 
 	emailChnl := make(chan Email, 10)
 	llmChnl := make(chan Email, 10)
 
+	if getConfiguration().Feedback {
+		checkExamplesTemplate()
+		// Pick up corrections made since the last run before new prompts are built
+		if err := syncFeedback(getNotionCreds().IntegrationSecret); err != nil {
+			fmt.Fprintf(os.Stderr, "Error syncing feedback: %v\n", err)
+		}
+	}
+
+	srv, transport := getGmailService()
+
 	wg.Add(3)
-	go getEmails(emailChnl, &wg)
-	go process(emailChnl, llmChnl, &wg)
+	go getEmails(srv, transport, emailChnl, &wg)
+	go runWorkers(srv, emailChnl, llmChnl, &wg)
 
 	// for email := range llmChnl {
 	// 	fmt.Printf("\n\nDate: %s\nFrom: %s\nTo: %s\nSubject: %s\n\n", email.date, email.from, email.to, email.subject)
@@ -140,6 +421,16 @@ func main() {
 
 	go updateNotion(llmChnl, &wg)
 	wg.Wait()
+
+	if err := deferPausedMessages(); err != nil {
+		fmt.Println("Unable to save the emails left for the next run: ", err)
+	}
+	if err := pruneCache(); err != nil {
+		fmt.Println("Unable to prune the cache: ", err)
+	}
+	if err := saveUsage(); err != nil {
+		fmt.Println("Unable to save usage totals: ", err)
+	}
 	fmt.Println("All goroutines have finished execution.")
 	// updateNotion(emails)
 }
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+	"github.com/tmc/langchaingo/llms/huggingface"
+	"github.com/tmc/langchaingo/llms/ollama"
+	"github.com/tmc/langchaingo/llms/openai"
+)
+
+const (
+	providerHuggingFace = "huggingface"
+	providerOllama      = "ollama"
+	providerOpenAI      = "openai"
+
+	defaultWorkers    = 4
+	defaultLLMTimeout = 60 * time.Second
+	// Room for the analysis of an email with a dozen action items and key dates
+	defaultMaxOutputTokens = 1500
+	// The free HuggingFace inference API starts rate limiting well before this
+	defaultRequestsPerMinute = 60
+	defaultMaxConcurrent     = 4
+)
+
+// Request limits for one LLM provider.
+type RateLimit struct {
+	RequestsPerMinute int `json:"requestsPerMinute"`
+	MaxConcurrent     int `json:"maxConcurrent"`
+}
+
+// The configured LLM provider.
+func providerName() string {
+	if provider := getConfiguration().Provider; provider != "" {
+		return provider
+	}
+	return providerHuggingFace
+}
+
+func newLLM(provider, model string) (llms.LLM, error) {
+	switch provider {
+	case providerHuggingFace:
+		return huggingface.New(
+			huggingface.WithToken(os.Getenv("HUGGINGFACEHUB_API_TOKEN")),
+			huggingface.WithModel(model),
+		)
+	case providerOllama:
+		options := []ollama.Option{ollama.WithModel(model)}
+		if url := getConfiguration().OllamaURL; url != "" {
+			options = append(options, ollama.WithServerURL(url))
+		}
+		return ollama.New(options...)
+	case providerOpenAI:
+		// The token is read from OPENAI_API_KEY
+		return openai.New(openai.WithModel(model))
+	case providerLocal:
+		return localLLM{}, nil
+	}
+	return nil, fmt.Errorf("unknown LLM provider %q, expected huggingface, ollama, openai or local", provider)
+}
+
+func maxOutputTokens() int {
+	if tokens := getConfiguration().MaxOutputTokens; tokens > 0 {
+		return tokens
+	}
+	return defaultMaxOutputTokens
+}
+
+// Options for a completion, in the form each provider understands.
+func callOptions(provider, model string) []llms.CallOption {
+	if provider == providerHuggingFace {
+		return []llms.CallOption{
+			llms.WithModel(model),
+			llms.WithMinLength(50),
+			llms.WithMaxLength(maxOutputTokens()),
+		}
+	}
+	return []llms.CallOption{
+		llms.WithModel(model),
+		llms.WithMaxTokens(maxOutputTokens()),
+	}
+}
+
+var (
+	llmClients   = make(map[string]llms.LLM)
+	llmClientsMu sync.Mutex
+)
+
+// The client for a provider and model, created once and shared by every worker.
+func getLLM(provider, model string) (llms.LLM, error) {
+	llmClientsMu.Lock()
+	defer llmClientsMu.Unlock()
+
+	key := provider + "/" + model
+	if llm, ok := llmClients[key]; ok {
+		return llm, nil
+	}
+	llm, err := newLLM(provider, model)
+	if err != nil {
+		return nil, err
+	}
+	llmClients[key] = llm
+	return llm, nil
+}
+
+// Limits the requests made to a provider per minute and how many run at once.
+type rateLimiter struct {
+	slots    chan struct{}
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	if limit.RequestsPerMinute <= 0 {
+		limit.RequestsPerMinute = defaultRequestsPerMinute
+	}
+	if limit.MaxConcurrent <= 0 {
+		limit.MaxConcurrent = defaultMaxConcurrent
+	}
+	return &rateLimiter{
+		slots:    make(chan struct{}, limit.MaxConcurrent),
+		interval: time.Minute / time.Duration(limit.RequestsPerMinute),
+	}
+}
+
+// Wait for a free slot and for the next request to be due.
+func (l *rateLimiter) acquire() {
+	l.slots <- struct{}{}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	time.Sleep(wait)
+}
+
+func (l *rateLimiter) release() {
+	<-l.slots
+}
+
+var (
+	rateLimiters   = make(map[string]*rateLimiter)
+	rateLimitersMu sync.Mutex
+)
+
+// Drop the clients and rate limiters so they are created from the current settings.
+func resetLLMClients() {
+	llmClientsMu.Lock()
+	llmClients = make(map[string]llms.LLM)
+	llmClientsMu.Unlock()
+	rateLimitersMu.Lock()
+	rateLimiters = make(map[string]*rateLimiter)
+	rateLimitersMu.Unlock()
+}
+
+func getRateLimiter(provider string) *rateLimiter {
+	rateLimitersMu.Lock()
+	defer rateLimitersMu.Unlock()
+
+	if limiter, ok := rateLimiters[provider]; ok {
+		return limiter
+	}
+	limiter := newRateLimiter(getConfiguration().RateLimits[provider])
+	rateLimiters[provider] = limiter
+	return limiter
+}
+
+// A provider and model to try, in the order of the fallback chain.
+type LLMBackend struct {
+	Provider   string `json:"provider"`
+	Model      string `json:"model"`
+	ChatFormat string `json:"chatFormat"`
+	// A Go duration such as 30s, defaults to llmTimeout
+	Timeout string `json:"timeout"`
+}
+
+func (b LLMBackend) name() string {
+	return b.Provider + "/" + b.Model
+}
+
+func (b LLMBackend) timeout() time.Duration {
+	timeout := b.Timeout
+	if timeout == "" {
+		timeout = getConfiguration().LLMTimeout
+	}
+	if timeout == "" {
+		return defaultLLMTimeout
+	}
+	duration, err := time.ParseDuration(timeout)
+	if err != nil {
+		fmt.Printf("Invalid timeout %q for %s, using %v: %v\n", timeout, b.name(), defaultLLMTimeout, err)
+		return defaultLLMTimeout
+	}
+	return duration
+}
+
+func (b LLMBackend) chatFormat() (ChatFormat, error) {
+	name := b.ChatFormat
+	if name == "" {
+		name = guessChatFormat(b.Model)
+	}
+	return lookupChatFormat(name)
+}
+
+// The configured model followed by the fallbacks. Fallbacks without a provider
+// use the configured one.
+func llmBackends() []LLMBackend {
+	config := getConfiguration()
+	backends := []LLMBackend{{
+		Provider:   providerName(),
+		Model:      modelName(),
+		ChatFormat: config.ChatFormat,
+	}}
+	for _, fallback := range config.Fallbacks {
+		if fallback.Provider == "" {
+			fallback.Provider = providerName()
+		}
+		backends = append(backends, fallback)
+	}
+	return backends
+}
+
+// Send a prompt to one backend, wrapped in its chat format, and return its answer.
+func complete(backend LLMBackend, prompt RenderedPrompt) (string, error) {
+	format, err := backend.chatFormat()
+	if err != nil {
+		return "", err
+	}
+	llm, err := getLLM(backend.Provider, backend.Model)
+	if err != nil {
+		return "", err
+	}
+	text := format.Render(prompt.System, prompt.User)
+
+	// Mask PII before it leaves the machine and put it back in the answer
+	var pii *redactor
+	if getConfiguration().Redact {
+		detectors, err := piiDetectors()
+		if err != nil {
+			return "", err
+		}
+		pii = newRedactor(detectors)
+		text = pii.redact(text)
+		if err := writeRedactionAudit(text, backend.Provider, pii.redactions); err != nil {
+			fmt.Println("Unable to write the redaction audit log: ", err)
+		}
+	}
+
+	// The local stand-in answers instantly and has no limits to respect
+	if backend.Provider != providerLocal {
+		limiter := getRateLimiter(backend.Provider)
+		limiter.acquire()
+		defer limiter.release()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), backend.timeout())
+	defer cancel()
+	start := time.Now()
+	generations, err := llm.Generate(ctx, []string{text}, callOptions(backend.Provider, backend.Model)...)
+	if err != nil {
+		return "", err
+	}
+	if len(generations) == 0 {
+		return "", fmt.Errorf("empty response")
+	}
+	completion := generations[0].Text
+
+	// Token counts as billed when the provider reports them, counted locally otherwise
+	call := UsageCall{
+		Provider: backend.Provider,
+		Model:    backend.Model,
+		Sender:   prompt.Sender,
+		Latency:  time.Since(start),
+	}
+	var ok bool
+	if call.PromptTokens, ok = generationTokens(generations[0].GenerationInfo, "PromptTokens"); !ok {
+		call.PromptTokens = countTokens(text)
+	}
+	if call.CompletionTokens, ok = generationTokens(generations[0].GenerationInfo, "CompletionTokens"); !ok {
+		call.CompletionTokens = countTokens(completion)
+	}
+	recordUsage(call)
+	if pii != nil {
+		completion = pii.restore(completion)
+	}
+	return completionText(format, completion), nil
+}
+
+// Try each backend in turn until attempt succeeds with one, which happens when it
+// answers in time with something the caller can use. Returns that backend.
+func withFallback(prompt RenderedPrompt, attempt func(backend LLMBackend) error) (string, error) {
+	var failures []string
+	for _, backend := range llmBackends() {
+		if err := attempt(backend); err != nil {
+			fmt.Printf("%s failed on the %s prompt: %v\n", backend.name(), prompt.Name, err)
+			failures = append(failures, backend.name()+": "+err.Error())
+			continue
+		}
+		return backend.name(), nil
+	}
+	return "", fmt.Errorf("every model failed, %s", strings.Join(failures, "; "))
+}
+
+// Send a prompt down the fallback chain and return the first answer with the
+// backend that gave it.
+func callLLM(prompt RenderedPrompt) (string, string, error) {
+	var answer string
+	model, err := withFallback(prompt, func(backend LLMBackend) error {
+		var err error
+		answer, err = complete(backend, prompt)
+		return err
+	})
+	return answer, model, err
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+const providerLocal = "local"
+
+// Phrases that mark a sentence as asking the reader to do something.
+var requestRegex = regexp.MustCompile(`(?i)\b(please|can you|could you|would you|need you to|make sure|remember to|don't forget|do not forget|action required|kindly)\b`)
+
+var sentenceRegex = regexp.MustCompile(`[^.!?\n]+[.!?]?`)
+
+// A deterministic stand-in for a hosted model, answering the analysis and merge
+// prompts with simple rules and every other prompt with an empty object. It needs
+// no network, so evaluations and dry runs can be repeated offline.
+type localLLM struct{}
+
+func (localLLM) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return localCompletion(prompt), nil
+}
+
+func (l localLLM) Generate(ctx context.Context, prompts []string, options ...llms.CallOption) ([]*llms.Generation, error) {
+	generations := make([]*llms.Generation, len(prompts))
+	for i, prompt := range prompts {
+		text, err := l.Call(ctx, prompt, options...)
+		if err != nil {
+			return nil, err
+		}
+		generations[i] = &llms.Generation{Text: text}
+	}
+	return generations, nil
+}
+
+// The content between the last pair of *** separators, where templates put the email.
+func promptContent(prompt string) string {
+	sections := strings.Split(prompt, "***********************************************************")
+	if len(sections) < 3 {
+		return prompt
+	}
+	content := strings.TrimSpace(sections[len(sections)-2])
+	// Drop the "Paragraph:" or "Parts:" label
+	if label, rest, ok := strings.Cut(content, "\n"); ok && strings.HasSuffix(label, ":") {
+		content = rest
+	}
+	return content
+}
+
+func localCompletion(prompt string) string {
+	if !strings.Contains(prompt, `"action_items"`) {
+		return "{}"
+	}
+
+	content := promptContent(prompt)
+	var parts []EmailAnalysis
+	if err := json.Unmarshal([]byte(content), &parts); err == nil {
+		return marshalLocalAnalysis(mergeAnalyses(parts))
+	}
+
+	var analysis EmailAnalysis
+	for _, line := range strings.Split(content, "\n") {
+		// Skip the headers included with the email text
+		if key, _, ok := strings.Cut(line, ": "); ok && (key == "From" || key == "To" || key == "Subject") {
+			continue
+		}
+		for _, sentence := range sentenceRegex.FindAllString(line, -1) {
+			sentence = strings.TrimSpace(sentence)
+			if sentence == "" || strings.HasPrefix(sentence, "(Part ") {
+				continue
+			}
+			if analysis.Summary == "" {
+				analysis.Summary = sentence
+			}
+			if strings.HasSuffix(sentence, "?") {
+				analysis.NeedsReply = true
+			}
+			if requestRegex.MatchString(sentence) {
+				analysis.ActionItems = append(analysis.ActionItems, ActionItem{Task: sentence})
+			}
+		}
+	}
+	return marshalLocalAnalysis(analysis)
+}
+
+func marshalLocalAnalysis(analysis EmailAnalysis) string {
+	if analysis.Summary == "" {
+		analysis.Summary = "No text"
+	}
+	if analysis.ActionItems == nil {
+		analysis.ActionItems = []ActionItem{}
+	}
+	if analysis.Categories == nil {
+		analysis.Categories = []string{}
+	}
+	if analysis.KeyDates == nil {
+		analysis.KeyDates = []KeyDate{}
+	}
+	analysis.People = nonNil(analysis.People)
+	analysis.Organizations = nonNil(analysis.Organizations)
+	data, err := json.Marshal(analysis)
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
@@ -5,9 +5,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-
 	"net/http"
+	"net/mail"
+	"net/url"
 	"os"
+	"strings"
 )
 
 const (
@@ -38,6 +40,11 @@ type RichText struct {
 
 type TextContent struct {
 	Content string `json:"content"`
+	Link    *Link  `json:"link,omitempty"`
+}
+
+type Link struct {
+	URL string `json:"url"`
 }
 
 type Annotations struct {
@@ -49,10 +56,17 @@ type Annotations struct {
 }
 
 type Property struct {
-	Type     string    `json:"type"`
-	Title    *struct{} `json:"title,omitempty"`
-	RichText *struct{} `json:"rich_text,omitempty"`
-	Date     *struct{} `json:"date,omitempty"`
+	Type        string         `json:"type"`
+	Title       *struct{}      `json:"title,omitempty"`
+	RichText    *struct{}      `json:"rich_text,omitempty"`
+	Date        *struct{}      `json:"date,omitempty"`
+	Email       *struct{}      `json:"email,omitempty"`
+	MultiSelect *SelectOptions `json:"multi_select,omitempty"`
+	URL         *struct{}      `json:"url,omitempty"`
+	Select      *SelectOptions `json:"select,omitempty"`
+	Checkbox    *struct{}      `json:"checkbox,omitempty"`
+	// Filled in by Notion with the time the row was last edited
+	LastEditedTime *struct{} `json:"last_edited_time,omitempty"`
 }
 
 type NotionDatabaseResponse struct {
@@ -60,10 +74,24 @@ type NotionDatabaseResponse struct {
 }
 
 type PageProperties struct {
-	Title    []RichText     `json:"title,omitempty"`
-	RichText []RichText     `json:"rich_text,omitempty"`
-	Date     *Date          `json:"date,omitempty"`
-	Checkbox *CheckboxValue `json:"checkbox,omitempty"`
+	Title       []RichText     `json:"title,omitempty"`
+	RichText    []RichText     `json:"rich_text,omitempty"`
+	Date        *Date          `json:"date,omitempty"`
+	Checkbox    *bool          `json:"checkbox,omitempty"`
+	Email       *string        `json:"email,omitempty"`
+	MultiSelect []SelectOption `json:"multi_select,omitempty"`
+	URL         *string        `json:"url,omitempty"`
+	Select      *SelectOption  `json:"select,omitempty"`
+}
+
+type SelectOption struct {
+	Name  string `json:"name"`
+	Color string `json:"color,omitempty"`
+}
+
+// The options of a select property, in the order Notion sorts them.
+type SelectOptions struct {
+	Options []SelectOption `json:"options,omitempty"`
 }
 
 type Date struct {
@@ -71,14 +99,48 @@ type Date struct {
 	End   interface{} `json:"end,omitempty"`
 }
 
-type CheckboxValue struct {
-	Name  string `json:"name"`
-	Value bool   `json:"value"`
-}
-
 type Page struct {
 	Parent     Parent                    `json:"parent"`
 	Properties map[string]PageProperties `json:"properties"`
+	Children   []Block                   `json:"children,omitempty"`
+}
+
+// A block in the body of a page. Notion API version 2021-05-13 calls the
+// rich text of a block "text".
+type Block struct {
+	Object           string     `json:"object"`
+	Type             string     `json:"type"`
+	ToDo             *TextBlock `json:"to_do,omitempty"`
+	Heading2         *TextBlock `json:"heading_2,omitempty"`
+	Heading3         *TextBlock `json:"heading_3,omitempty"`
+	Paragraph        *TextBlock `json:"paragraph,omitempty"`
+	BulletedListItem *TextBlock `json:"bulleted_list_item,omitempty"`
+}
+
+type TextBlock struct {
+	Text    []RichText `json:"text"`
+	Checked bool       `json:"checked,omitempty"`
+}
+
+// A page as returned by the Notion API.
+type NotionPage struct {
+	ID          string                    `json:"id"`
+	URL         string                    `json:"url"`
+	CreatedTime string                    `json:"created_time"`
+	Archived    bool                      `json:"archived"`
+	Properties  map[string]PageProperties `json:"properties"`
+}
+
+type blockChildrenResponse struct {
+	Results    []Block `json:"results"`
+	HasMore    bool    `json:"has_more"`
+	NextCursor string  `json:"next_cursor"`
+}
+
+type databaseQueryResponse struct {
+	Results    []NotionPage `json:"results"`
+	HasMore    bool         `json:"has_more"`
+	NextCursor string       `json:"next_cursor"`
 }
 
 type DatabaseInfo struct {
@@ -131,10 +193,162 @@ func writeDatabaseInfo(dbInfoList DatabaseInfoList) error {
 	return nil
 }
 
-func createNotionDatabase(integrationSecret, parentPageID, dbName string) (string, error) {
-	url := notionAPIBaseURL + "databases"
-	client := &http.Client{}
+// Send a request to the Notion API and return the response body.
+// Any non 200 response is returned as an error including the body Notion sent back.
+func doNotionRequest(integrationSecret, method, path string, payload any) ([]byte, error) {
+	var reqBody io.Reader
+	if payload != nil {
+		jsonData, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewBuffer(jsonData)
+	}
+
+	req, err := http.NewRequest(method, notionAPIBaseURL+path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+integrationSecret)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Notion-Version", notionAPIVersion)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s, response: %s", resp.Status, string(body))
+	}
+
+	return body, nil
+}
+
+// The properties every email database is created with.
+func databaseProperties() map[string]Property {
+	return map[string]Property{
+		"Email From": {
+			Type:  "title",
+			Title: &struct{}{},
+		},
+		"Date": {
+			Type: "date",
+			Date: &struct{}{},
+		},
+		"Subject": {
+			Type:     "rich_text",
+			RichText: &struct{}{},
+		},
+		"Summary": {
+			Type:     "rich_text",
+			RichText: &struct{}{},
+		},
+		"Sender Name": {
+			Type:     "rich_text",
+			RichText: &struct{}{},
+		},
+		"Sender Email": {
+			Type:  "email",
+			Email: &struct{}{},
+		},
+		"Recipients": {
+			Type:        "multi_select",
+			MultiSelect: &SelectOptions{},
+		},
+		"Open in Gmail": {
+			Type: "url",
+			URL:  &struct{}{},
+		},
+		"Reply Draft": {
+			Type: "url",
+			URL:  &struct{}{},
+		},
+		"Priority": {
+			Type:   "select",
+			Select: &SelectOptions{Options: priorityOptions()},
+		},
+		"Priority Reason": {
+			Type:     "rich_text",
+			RichText: &struct{}{},
+		},
+		"Warning": {
+			Type:   "select",
+			Select: &SelectOptions{Options: warningOptions()},
+		},
+		"Warning Reasons": {
+			Type:     "rich_text",
+			RichText: &struct{}{},
+		},
+		"Model": {
+			Type:     "rich_text",
+			RichText: &struct{}{},
+		},
+		"Action Items": {
+			Type:     "rich_text",
+			RichText: &struct{}{},
+		},
+		"Has Action Items": {
+			Type:     "checkbox",
+			Checkbox: &struct{}{},
+		},
+		"Due Date": {
+			Type: "date",
+			Date: &struct{}{},
+		},
+		"Categories": {
+			Type:        "multi_select",
+			MultiSelect: &SelectOptions{Options: categoryOptions()},
+		},
+		"Needs Reply": {
+			Type:     "checkbox",
+			Checkbox: &struct{}{},
+		},
+		"Key Dates": {
+			Type:     "rich_text",
+			RichText: &struct{}{},
+		},
+		"People": {
+			Type:        "multi_select",
+			MultiSelect: &SelectOptions{},
+		},
+		"Organizations": {
+			Type:        "multi_select",
+			MultiSelect: &SelectOptions{},
+		},
+		"Amounts": {
+			Type:     "rich_text",
+			RichText: &struct{}{},
+		},
+		"Reference Numbers": {
+			Type:     "rich_text",
+			RichText: &struct{}{},
+		},
+		"Last Edited": {
+			Type:           "last_edited_time",
+			LastEditedTime: &struct{}{},
+		},
+	}
+}
+
+// Add any properties missing from a database created by an older version of Jot.
+func syncDatabaseProperties(integrationSecret, databaseID string, properties map[string]Property) error {
+	update := map[string]any{"properties": properties}
+	_, err := doNotionRequest(integrationSecret, "PATCH", "databases/"+databaseID, update)
+	if err != nil {
+		return fmt.Errorf("failed to update database properties: %v", err)
+	}
+	return nil
+}
 
+func createNotionDatabase(integrationSecret, parentPageID, dbName string, properties map[string]Property) (string, error) {
 	database := NotionDatabase{
 		Parent: Parent{
 			Type:   "page_id",
@@ -152,68 +366,274 @@ func createNotionDatabase(integrationSecret, parentPageID, dbName string) (strin
 				PlainText: dbName,
 			},
 		},
-		Properties: map[string]Property{
-			"Email From": {
-				Type:  "title",
-				Title: &struct{}{},
-			},
-			"Date": {
-				Type: "date",
-				Date: &struct{}{},
-			},
-			"Subject": {
-				Type:     "rich_text",
-				RichText: &struct{}{},
-			},
-			"Summary": {
-				Type:     "rich_text",
-				RichText: &struct{}{},
-			},
-		},
+		Properties: properties,
 	}
 
-	jsonData, err := json.Marshal(database)
+	body, err := doNotionRequest(integrationSecret, "POST", "databases", database)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("failed to create database: %v", err)
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	var notionResp NotionDatabaseResponse
+	err = json.Unmarshal(body, &notionResp)
 	if err != nil {
 		return "", err
 	}
 
-	req.Header.Set("Authorization", "Bearer "+integrationSecret)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Notion-Version", notionAPIVersion)
+	return notionResp.ID, nil
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
+// Fetch every page of a database matching the filter, following Notion's pagination.
+// A nil filter returns all pages.
+func queryDatabase(integrationSecret, databaseID string, filter any) ([]NotionPage, error) {
+	var pages []NotionPage
+	cursor := ""
+	for {
+		query := map[string]any{"page_size": 100}
+		if filter != nil {
+			query["filter"] = filter
+		}
+		if cursor != "" {
+			query["start_cursor"] = cursor
+		}
+
+		body, err := doNotionRequest(integrationSecret, "POST", "databases/"+databaseID+"/query", query)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query database: %v", err)
+		}
+		var resp databaseQueryResponse
+		if err := json.Unmarshal(body, &resp); err != nil {
+			return nil, err
+		}
+		pages = append(pages, resp.Results...)
+
+		if !resp.HasMore || resp.NextCursor == "" {
+			return pages, nil
+		}
+		cursor = resp.NextCursor
 	}
-	defer resp.Body.Close()
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("failed to create database: %s", resp.Status)
+// Fetch the blocks in the body of a page.
+func readBlockChildren(integrationSecret, blockID string) ([]Block, error) {
+	var blocks []Block
+	cursor := ""
+	for {
+		path := "blocks/" + blockID + "/children?page_size=100"
+		if cursor != "" {
+			path += "&start_cursor=" + url.QueryEscape(cursor)
+		}
+
+		body, err := doNotionRequest(integrationSecret, "GET", path, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read blocks: %v", err)
+		}
+		var resp blockChildrenResponse
+		if err := json.Unmarshal(body, &resp); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, resp.Results...)
+
+		if !resp.HasMore || resp.NextCursor == "" {
+			return blocks, nil
+		}
+		cursor = resp.NextCursor
 	}
+}
 
-	body, err := io.ReadAll(resp.Body)
+// Create a page under a parent page, adding blocks beyond the 100 Notion accepts
+// in one request afterwards.
+func createChildPage(integrationSecret, parentPageID, title string, blocks []Block) (NotionPage, error) {
+	first := blocks
+	if len(first) > 100 {
+		first = first[:100]
+	}
+	page := Page{
+		Parent: Parent{
+			Type:   "page_id",
+			PageID: parentPageID,
+		},
+		Properties: map[string]PageProperties{
+			"title": {Title: plainRichText(title)},
+		},
+		Children: first,
+	}
+
+	body, err := doNotionRequest(integrationSecret, "POST", "pages", page)
 	if err != nil {
-		return "", err
+		return NotionPage{}, fmt.Errorf("failed to create page: %v", err)
+	}
+	var created NotionPage
+	if err := json.Unmarshal(body, &created); err != nil {
+		return NotionPage{}, err
 	}
 
-	var notionResp NotionDatabaseResponse
-	err = json.Unmarshal(body, &notionResp)
+	for start := len(first); start < len(blocks); start += 100 {
+		children := map[string]any{"children": blocks[start:min(start+100, len(blocks))]}
+		if _, err := doNotionRequest(integrationSecret, "PATCH", "blocks/"+created.ID+"/children", children); err != nil {
+			return created, fmt.Errorf("failed to add blocks to page: %v", err)
+		}
+	}
+	return created, nil
+}
+
+// Move a page to the trash.
+func archivePage(integrationSecret, pageID string) error {
+	_, err := doNotionRequest(integrationSecret, "PATCH", "pages/"+pageID, map[string]any{"archived": true})
 	if err != nil {
-		return "", err
+		return fmt.Errorf("failed to archive page: %v", err)
 	}
+	return nil
+}
 
-	return notionResp.ID, nil
+// The plain text of a title or rich text property.
+func propertyText(property PageProperties) string {
+	richText := property.RichText
+	if len(property.Title) > 0 {
+		richText = property.Title
+	}
+	var sb strings.Builder
+	for _, text := range richText {
+		if text.PlainText != "" {
+			sb.WriteString(text.PlainText)
+		} else {
+			sb.WriteString(text.Text.Content)
+		}
+	}
+	return sb.String()
+}
+
+// The names of the options chosen in a multi-select property.
+func propertyOptions(property PageProperties) []string {
+	names := make([]string, len(property.MultiSelect))
+	for i, option := range property.MultiSelect {
+		names[i] = option.Name
+	}
+	return names
+}
+
+// Notion limits the content of a single rich text object to 2000 characters
+const richTextLimit = 2000
+
+// Wrap plain text in the rich text array Notion expects, split into pieces
+// Notion accepts.
+func plainRichText(content string) []RichText {
+	runes := []rune(content)
+	richText := []RichText{}
+	for start := 0; start == 0 || start < len(runes); start += richTextLimit {
+		piece := string(runes[start:min(start+richTextLimit, len(runes))])
+		richText = append(richText, RichText{
+			Type: "text",
+			Text: TextContent{
+				Content: piece,
+			},
+			PlainText: piece,
+		})
+	}
+	return richText
+}
+
+// Turn names into multi-select options, which cannot contain commas or be longer than 100 characters.
+func namesToOptions(names []string) []SelectOption {
+	var options []SelectOption
+	for _, name := range names {
+		name = strings.TrimSpace(strings.ReplaceAll(name, ",", ""))
+		if name == "" {
+			continue
+		}
+		if runes := []rune(name); len(runes) > 100 {
+			name = string(runes[:100])
+		}
+		options = append(options, SelectOption{Name: name})
+	}
+	return options
+}
+
+func headingBlock(level int, text string) Block {
+	if level == 2 {
+		return Block{Object: "block", Type: "heading_2", Heading2: &TextBlock{Text: plainRichText(text)}}
+	}
+	return Block{Object: "block", Type: "heading_3", Heading3: &TextBlock{Text: plainRichText(text)}}
+}
+
+func paragraphBlock(richText []RichText) Block {
+	return Block{
+		Object:    "block",
+		Type:      "paragraph",
+		Paragraph: &TextBlock{Text: richText},
+	}
+}
+
+// Rich text linking to href, unless href is empty.
+func linkText(content, href string) RichText {
+	text := RichText{
+		Type:      "text",
+		Text:      TextContent{Content: content},
+		PlainText: content,
+	}
+	if href != "" {
+		text.Text.Link = &Link{URL: href}
+	}
+	return text
+}
+
+func bulletBlock(richText []RichText) Block {
+	return Block{
+		Object:           "block",
+		Type:             "bulleted_list_item",
+		BulletedListItem: &TextBlock{Text: richText},
+	}
+}
+
+// A details section listing the dates and links found in the email.
+func entityBlocks(entities Entities) []Block {
+	if len(entities.Dates) == 0 && len(entities.URLs) == 0 {
+		return nil
+	}
+
+	blocks := []Block{{
+		Object:   "block",
+		Type:     "heading_3",
+		Heading3: &TextBlock{Text: plainRichText("Details")},
+	}}
+	for _, date := range entities.Dates {
+		blocks = append(blocks, bulletBlock(plainRichText("Date: "+date)))
+	}
+	for _, link := range entities.URLs {
+		if len(link) > richTextLimit {
+			continue
+		}
+		blocks = append(blocks, bulletBlock([]RichText{{
+			Type: "text",
+			Text: TextContent{
+				Content: link,
+				Link:    &Link{URL: link},
+			},
+			PlainText: link,
+		}}))
+	}
+	return blocks
 }
 
-func addPageToDatabase(integrationSecret, databaseID string, email Email) error {
-	url := notionAPIBaseURL + "pages"
-	client := &http.Client{}
+// A to-do block for each action item, so they can be checked off in Notion.
+func actionItemBlocks(items []ActionItem) []Block {
+	var blocks []Block
+	for _, item := range items {
+		text := item.Task
+		if item.Due != "" {
+			text += " (due " + item.Due + ")"
+		}
+		blocks = append(blocks, Block{
+			Object: "block",
+			Type:   "to_do",
+			ToDo:   &TextBlock{Text: plainRichText(text)},
+		})
+	}
+	return blocks
+}
 
+// Add an email's row to a database and return the new page.
+func addPageToDatabase(integrationSecret, databaseID string, email Email) (NotionPage, error) {
 	page := Page{
 		Parent: Parent{
 			Type:       "database_id",
@@ -236,22 +656,7 @@ func addPageToDatabase(integrationSecret, databaseID string, email Email) error
 				},
 			},
 			"Summary": {
-				RichText: []RichText{
-					{
-						Type: "text",
-						Text: TextContent{
-							Content: email.summary,
-						},
-						Annotations: Annotations{
-							Bold:          false,
-							Italic:        false,
-							Strikethrough: false,
-							Underline:     false,
-							Code:          false,
-						},
-						PlainText: email.summary,
-					},
-				},
+				RichText: plainRichText(email.summary),
 			},
 			"Subject": {
 				RichText: []RichText{
@@ -274,30 +679,104 @@ func addPageToDatabase(integrationSecret, databaseID string, email Email) error
 		},
 	}
 
-	jsonData, err := json.Marshal(page)
-	if err != nil {
-		return err
+	if email.sender != nil {
+		page.Properties["Sender Name"] = PageProperties{
+			RichText: plainRichText(email.sender.Name),
+		}
+		if email.sender.Address != "" {
+			senderEmail := email.sender.Address
+			page.Properties["Sender Email"] = PageProperties{Email: &senderEmail}
+		}
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return err
+	recipients := recipientOptions(email)
+	if len(recipients) > 0 {
+		page.Properties["Recipients"] = PageProperties{MultiSelect: recipients}
 	}
 
-	req.Header.Set("Authorization", "Bearer "+integrationSecret)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Notion-Version", notionAPIVersion)
+	if link := messageLink(email); link != "" {
+		page.Properties["Open in Gmail"] = PageProperties{URL: &link}
+	}
+
+	hasActionItems := len(email.actionItems) > 0
+	needsReply := email.needsReply
+	page.Properties["Action Items"] = PageProperties{RichText: plainRichText(formatActionItems(email.actionItems))}
+	page.Properties["Has Action Items"] = PageProperties{Checkbox: &hasActionItems}
+	page.Properties["Needs Reply"] = PageProperties{Checkbox: &needsReply}
+	page.Properties["Key Dates"] = PageProperties{RichText: plainRichText(formatKeyDates(email.keyDates))}
+	if due := earliestDue(email.actionItems); due != "" {
+		page.Properties["Due Date"] = PageProperties{Date: &Date{Start: due}}
+	}
+	if len(email.categories) > 0 {
+		categories := make([]SelectOption, len(email.categories))
+		for i, name := range email.categories {
+			categories[i] = SelectOption{Name: name}
+		}
+		page.Properties["Categories"] = PageProperties{MultiSelect: categories}
+	}
+	if people := namesToOptions(email.entities.People); len(people) > 0 {
+		page.Properties["People"] = PageProperties{MultiSelect: people}
+	}
+	if organizations := namesToOptions(email.entities.Organizations); len(organizations) > 0 {
+		page.Properties["Organizations"] = PageProperties{MultiSelect: organizations}
+	}
+	page.Properties["Amounts"] = PageProperties{RichText: plainRichText(formatAmounts(email.entities.Amounts))}
+	page.Properties["Reference Numbers"] = PageProperties{RichText: plainRichText(formatReferenceNumbers(email.entities.ReferenceNumbers))}
 
-	resp, err := client.Do(req)
+	page.Children = append(actionItemBlocks(email.actionItems), entityBlocks(email.entities)...)
+	// Notion accepts at most 100 blocks when creating a page
+	if len(page.Children) > 100 {
+		page.Children = page.Children[:100]
+	}
+
+	if email.priority != "" {
+		page.Properties["Priority"] = PageProperties{Select: &SelectOption{Name: email.priority}}
+		page.Properties["Priority Reason"] = PageProperties{RichText: plainRichText(email.priorityReason)}
+	}
+
+	if email.suspicious {
+		page.Properties["Warning"] = PageProperties{Select: &SelectOption{Name: warningPhishing}}
+		page.Properties["Warning Reasons"] = PageProperties{RichText: plainRichText(strings.Join(email.phishingReasons, "; "))}
+	} else if email.analysisError != "" {
+		page.Properties["Warning"] = PageProperties{Select: &SelectOption{Name: warningAnalysisFailed}}
+		page.Properties["Warning Reasons"] = PageProperties{RichText: plainRichText(email.analysisError)}
+	}
+
+	if email.model != "" {
+		page.Properties["Model"] = PageProperties{RichText: plainRichText(email.model)}
+	}
+
+	if email.draftLink != "" {
+		draftLink := email.draftLink
+		page.Properties["Reply Draft"] = PageProperties{URL: &draftLink}
+	}
+
+	body, err := doNotionRequest(integrationSecret, "POST", "pages", page)
 	if err != nil {
-		return err
+		return NotionPage{}, fmt.Errorf("failed to add page: %v", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("failed to add page: %s, response: %s", resp.Status, string(body))
+	var created NotionPage
+	if err := json.Unmarshal(body, &created); err != nil {
+		return NotionPage{}, err
 	}
+	return created, nil
+}
 
-	return nil
+// Collect the To and Cc addresses as multi-select options, without duplicates.
+func recipientOptions(email Email) []SelectOption {
+	var options []SelectOption
+	seen := make(map[string]bool)
+	for _, addresses := range [][]*mail.Address{email.recipients, email.cc} {
+		for _, address := range addresses {
+			// Notion rejects option names containing commas
+			name := strings.ReplaceAll(strings.ToLower(address.Address), ",", "")
+			if name == "" || seen[name] {
+				continue
+			}
+			seen[name] = true
+			options = append(options, SelectOption{Name: name})
+		}
+	}
+	return options
 }
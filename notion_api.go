@@ -6,7 +6,6 @@ import (
 	"io"
 	"log"
 	"os"
-	"strings"
 	"sync"
 )
 
@@ -36,6 +35,43 @@ func getNotionCreds() Config {
 	return config
 }
 
+// Look up the ID of the named database, creating it with the given properties if
+// it does not exist yet. Existing databases have their properties brought up to
+// date once per run, tracked in synced.
+func ensureDatabase(integrationSecret, parentPageID, dbName string, properties map[string]Property, synced map[string]bool) (string, error) {
+	dbInfoList, err := readDatabaseInfo(dbName)
+	if err != nil {
+		return "", fmt.Errorf("error reading database info: %v", err)
+	}
+	dbID, dbExists := findDatabaseID(dbInfoList, dbName)
+
+	if !dbExists {
+		newDBID, err := createNotionDatabase(integrationSecret, parentPageID, dbName, properties)
+		if err != nil {
+			return "", fmt.Errorf("error creating database: %v", err)
+		}
+
+		fmt.Printf("Database created successfully with ID: %s\n", newDBID)
+
+		dbInfoList.Databases = append(dbInfoList.Databases, DatabaseInfo{Name: dbName, ID: newDBID})
+
+		err = writeDatabaseInfo(dbInfoList)
+		if err != nil {
+			return "", fmt.Errorf("error writing database info: %v", err)
+		}
+		synced[newDBID] = true
+		return newDBID, nil
+	}
+
+	if !synced[dbID] {
+		if err := syncDatabaseProperties(integrationSecret, dbID, properties); err != nil {
+			fmt.Fprintf(os.Stderr, "Error updating database properties: %v\n", err)
+		}
+		synced[dbID] = true
+	}
+	return dbID, nil
+}
+
 func updateNotion(llmChnl <-chan Email, wg *sync.WaitGroup) {
 	defer wg.Done()
 	// current_time := time.Now().UTC()
@@ -46,9 +82,43 @@ func updateNotion(llmChnl <-chan Email, wg *sync.WaitGroup) {
 	// year, month, day := current_time.Date()
 	// dbName := fmt.Sprintf("%d-%02d-%02d-Database", year, month, day)
 
+	// Databases whose properties have been checked against the current schema this run
+	syncedDatabases := make(map[string]bool)
+	// Days that got new rows, in the order they were first seen
+	var days []string
+	seenDays := make(map[string]bool)
+
+	var feedback *FeedbackStore
+	if getConfiguration().Feedback {
+		var err error
+		if feedback, err = readFeedbackStore(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading feedback, new rows will not be watched for corrections: %v\n", err)
+		}
+	}
+
+	var index *SearchIndex
+	if getConfiguration().SearchIndex {
+		var err error
+		if index, err = readSearchIndex(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading the search index, emails will not be indexed: %v\n", err)
+		}
+	}
+
 	for email := range llmChnl {
-		currEmailDate := strings.Split(email.date, "T")[0]
-		// fmt.Println(currEmailDate)
+		if email.sent {
+			// Commitments span days, so they all go into a single database
+			dbID, err := ensureDatabase(integrationSecret, parentPageID, commitmentsDatabaseName, commitmentProperties(), syncedDatabases)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				os.Exit(1)
+			}
+			if err := addCommitmentsToDatabase(integrationSecret, dbID, email); err != nil {
+				fmt.Fprintf(os.Stderr, "\n\nError adding commitments to database: %v\n", err)
+			}
+			continue
+		}
+
+		currEmailDate := emailDay(email)
 		currEmailDbName := fmt.Sprintf("%s-Database", currEmailDate)
 
 		// Create a database with todays date,
@@ -56,38 +126,50 @@ func updateNotion(llmChnl <-chan Email, wg *sync.WaitGroup) {
 		// if yes, add the email summary to that database
 		// else, create a new database and add summary
 
-		dbInfoList, err := readDatabaseInfo(currEmailDbName)
+		dbID, err := ensureDatabase(integrationSecret, parentPageID, currEmailDbName, databaseProperties(), syncedDatabases)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error reading database info: %v\n", err)
+			fmt.Fprintf(os.Stderr, "%v\n", err)
 			os.Exit(1)
 		}
-		dbID, dbExists := findDatabaseID(dbInfoList, currEmailDbName)
-
-		if !dbExists {
-			newDBID, err := createNotionDatabase(integrationSecret, parentPageID, currEmailDbName)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error creating database: %v\n", err)
-				os.Exit(1)
-			}
-
-			fmt.Printf("Database created successfully with ID: %s\n", dbID)
-
-			dbInfoList.Databases = append(dbInfoList.Databases, DatabaseInfo{Name: currEmailDbName, ID: newDBID})
-
-			err = writeDatabaseInfo(dbInfoList)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error writing database info: %v\n", err)
-				os.Exit(1)
-			}
-			dbID = newDBID
-		}
 
-		err = addPageToDatabase(integrationSecret, dbID, email)
+		page, err := addPageToDatabase(integrationSecret, dbID, email)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "\n\nError adding page to database: %v\n", err)
 			// os.Exit(1)
+			continue
+		}
+		// Only emails with a row are indexed, so every search result links to one
+		if index != nil && email.indexEntry != nil {
+			email.indexEntry.NotionURL = page.URL
+			index.add(*email.indexEntry)
+		}
+		if feedback != nil {
+			feedback.addRecord(page.ID, dbID, email)
+		}
+		if !seenDays[currEmailDate] {
+			seenDays[currEmailDate] = true
+			days = append(days, currEmailDate)
 		}
 	}
 
 	fmt.Println("Page added successfully to the database")
+
+	if feedback != nil {
+		if err := feedback.save(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error saving feedback: %v\n", err)
+		}
+	}
+	if index != nil {
+		if err := index.save(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error saving the search index: %v\n", err)
+		}
+	}
+
+	if getConfiguration().Digest {
+		for _, day := range days {
+			if err := writeDigest(integrationSecret, parentPageID, day); err != nil {
+				fmt.Fprintf(os.Stderr, "Error writing digest for %s: %v\n", day, err)
+			}
+		}
+	}
 }
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// A rule for emails from a known system with a predictable format, such as CI
+// failures or calendar invitations, that produces their summary and action
+// items without the LLM.
+//
+// An email matches when its sender is one of Senders and its subject matches
+// Subject, whichever of the two are set. Fields are then taken from the named
+// groups of the Subject regex and of Patterns, run over the subject and text,
+// and from Selectors on the HTML body. Summary and the action items are Go
+// templates over those fields and Subject, Sender and SenderEmail.
+type EmailParser struct {
+	Name string `json:"name"`
+	// Full addresses, domains written as "@example.com" that also cover their
+	// subdomains, or mailbox names on any domain written as "jenkins@"
+	Senders []string `json:"senders"`
+	Subject string   `json:"subject"`
+
+	Patterns []string `json:"patterns"`
+	// Field name to a selector such as "td.status", "a[href*=/runs/]@href" or
+	// "table tr b", the text of the first match or the attribute after @
+	Selectors map[string]string `json:"selectors"`
+
+	Summary     string             `json:"summary"`
+	ActionItems []ParserActionItem `json:"actionItems"`
+	Categories  []string           `json:"categories"`
+	NeedsReply  bool               `json:"needsReply"`
+}
+
+type ParserActionItem struct {
+	Task string `json:"task"`
+	// Template for a YYYY-MM-DD due date, dropped when it renders anything else
+	Due string `json:"due"`
+	// A field that must have been found for the item to be added
+	When string `json:"when"`
+}
+
+// The parsers that come with Jot, after the ones in the settings. Each only
+// handles mail from the systems it was written for.
+var builtinParsers = []EmailParser{
+	{
+		Name:    "github-actions",
+		Senders: []string{"notifications@github.com"},
+		Subject: `^\[(?P<repo>[^\]]+)\] Run failed: (?P<workflow>.+?) - (?P<branch>\S+)`,
+		Summary: "The {{.workflow}} workflow failed on {{.branch}} in {{.repo}}.",
+		ActionItems: []ParserActionItem{
+			{Task: "Fix the failing {{.workflow}} workflow on {{.branch}} in {{.repo}}"},
+		},
+	},
+	{
+		Name:    "gitlab-pipeline",
+		Senders: []string{"@gitlab.com", "gitlab@"},
+		Subject: `^Failed pipeline for (?P<branch>\S+) \| (?P<repo>[^|]+?)(?: \|.*)?$`,
+		Summary: "The pipeline for {{.branch}} failed in {{.repo}}.",
+		ActionItems: []ParserActionItem{
+			{Task: "Fix the failing pipeline for {{.branch}} in {{.repo}}"},
+		},
+	},
+	{
+		Name:    "jenkins",
+		Senders: []string{"jenkins@"},
+		Subject: `^Build failed in Jenkins: (?P<job>.+?) #(?P<build>\d+)`,
+		Summary: "Jenkins build {{.build}} of {{.job}} failed.",
+		ActionItems: []ParserActionItem{
+			{Task: "Fix the failing Jenkins build {{.build}} of {{.job}}"},
+		},
+	},
+	{
+		Name:    "jira",
+		Senders: []string{"@atlassian.net", "jira@"},
+		Subject: `^\[JIRA\]\s*(?:\(|.*?\b)(?P<key>[A-Z][A-Z0-9]+-\d+)\)?:?\s*(?P<title>.*)$`,
+		Patterns: []string{
+			`(?i)(?P<assigned>assigned (?:this issue |it |\S+ )?to you|you(?: were|'ve been| have been) assigned)`,
+			`(?i)(?P<mentioned>mentioned you)`,
+		},
+		Summary: "Jira issue {{.key}} {{.title}} was updated{{if .assigned}} and assigned to you{{end}}.",
+		ActionItems: []ParserActionItem{
+			{Task: "Work on {{.key}}: {{.title}}", When: "assigned"},
+			{Task: "Answer the mention in {{.key}}: {{.title}}", When: "mentioned"},
+		},
+	},
+	{
+		Name:    "calendar-invitation",
+		Senders: calendarSenders,
+		Subject: `^(?:Updated )?[Ii]nvitation: (?P<event>.+?) @ (?P<when>.+?)(?: \([^()]*\))?$`,
+		Summary: "Invitation to {{.event}} on {{.when}}.",
+		ActionItems: []ParserActionItem{
+			{Task: "Respond to the invitation to {{.event}} on {{.when}}"},
+		},
+	},
+	{
+		Name:    "calendar-cancellation",
+		Senders: calendarSenders,
+		Subject: `^(?:Canceled|Cancelled) event(?: with note)?: (?P<event>.+?) @ (?P<when>.+?)(?: \([^()]*\))?$`,
+		Summary: "{{.event}} on {{.when}} was canceled.",
+	},
+	{
+		Name:    "calendar-response",
+		Senders: calendarSenders,
+		Subject: `^(?P<response>Accepted|Declined|Tentatively [Aa]ccepted): (?P<event>.+?) @ (?P<when>.+?)(?: \([^()]*\))?$`,
+		Summary: "{{.Sender}}: {{.response}} {{.event}} on {{.when}}.",
+	},
+	{
+		Name:    "shipping",
+		Senders: shippingSenders,
+		Subject: `(?i)^(?:(?:shipped|delivered|out for delivery):|(?:your |an? )?(?:[\w'#.-]+ ){0,6}?(?:order|package|parcel|shipment|items?)\b.*\b(?:has shipped|have shipped|has been shipped|is on (?:its|the) way|is out for delivery|(?:has been|was) delivered)\b)`,
+		Patterns: []string{
+			`(?i)tracking (?:number|no\.?|#|id)[:#\s]*(?P<tracking>[A-Z0-9]{8,34})\b`,
+			`\b(?P<carrier>UPS|FedEx|USPS|DHL|Royal Mail|Canada Post|Amazon Logistics)\b`,
+			`(?i)(?:arriving|estimated delivery|expected delivery|delivery date)[:\s]+(?P<eta>[^\n.]{3,40})`,
+		},
+		Summary: "{{.Subject}}{{if .carrier}} via {{.carrier}}{{end}}{{if .tracking}}, tracking number {{.tracking}}{{end}}{{if .eta}}, arriving {{.eta}}{{end}}.",
+	},
+}
+
+// Google Calendar sends invitations and replies from its own address, with the
+// organizer or guest as the display name.
+var calendarSenders = []string{"calendar-notification@google.com", "@calendar.google.com"}
+
+// Carriers and the retailers and tracking services that send shipping updates.
+var shippingSenders = []string{
+	"@ups.com", "@fedex.com", "@usps.com", "@dhl.com", "@royalmail.com", "@canadapost.ca",
+	"@amazon.com", "@amazon.co.uk", "@amazon.de", "@ebay.com", "@etsy.com", "@walmart.com",
+	"@target.com", "@bestbuy.com", "@shopify.com", "@shop.app", "@aftership.com", "@narvar.com",
+}
+
+// A parser with its regexes and templates compiled.
+type compiledParser struct {
+	EmailParser
+	subject  *regexp.Regexp
+	patterns []*regexp.Regexp
+	summary  *template.Template
+	tasks    []*template.Template
+	dues     []*template.Template
+}
+
+func compileParser(parser EmailParser) (compiledParser, error) {
+	compiled := compiledParser{EmailParser: parser}
+	if len(parser.Senders) == 0 && parser.Subject == "" {
+		return compiled, fmt.Errorf("parser %q needs senders or a subject", parser.Name)
+	}
+	var err error
+	if parser.Subject != "" {
+		if compiled.subject, err = regexp.Compile(parser.Subject); err != nil {
+			return compiled, fmt.Errorf("invalid subject of parser %q: %v", parser.Name, err)
+		}
+	}
+	for _, pattern := range parser.Patterns {
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return compiled, fmt.Errorf("invalid pattern of parser %q: %v", parser.Name, err)
+		}
+		compiled.patterns = append(compiled.patterns, regex)
+	}
+	for field, selector := range parser.Selectors {
+		if _, err := parseSelector(selector); err != nil {
+			return compiled, fmt.Errorf("invalid selector %q of parser %q: %v", field, parser.Name, err)
+		}
+	}
+
+	newTemplate := func(text string) (*template.Template, error) {
+		return template.New(parser.Name).Option("missingkey=zero").Parse(text)
+	}
+	if compiled.summary, err = newTemplate(parser.Summary); err != nil {
+		return compiled, fmt.Errorf("invalid summary of parser %q: %v", parser.Name, err)
+	}
+	for _, item := range parser.ActionItems {
+		task, err := newTemplate(item.Task)
+		if err != nil {
+			return compiled, fmt.Errorf("invalid action item of parser %q: %v", parser.Name, err)
+		}
+		due, err := newTemplate(item.Due)
+		if err != nil {
+			return compiled, fmt.Errorf("invalid due date of parser %q: %v", parser.Name, err)
+		}
+		compiled.tasks = append(compiled.tasks, task)
+		compiled.dues = append(compiled.dues, due)
+	}
+	return compiled, nil
+}
+
+var (
+	emailParsers     []compiledParser
+	emailParsersOnce sync.Once
+)
+
+// The parsers from the settings followed by the built in ones not disabled.
+// Parsers that do not compile are reported and skipped.
+func getEmailParsers() []compiledParser {
+	emailParsersOnce.Do(func() {
+		config := getConfiguration()
+		disabled := make(map[string]bool)
+		for _, name := range config.DisabledParsers {
+			disabled[name] = true
+		}
+
+		parsers := append([]EmailParser{}, config.Parsers...)
+		for _, parser := range builtinParsers {
+			if !disabled[parser.Name] {
+				parsers = append(parsers, parser)
+			}
+		}
+		for _, parser := range parsers {
+			compiled, err := compileParser(parser)
+			if err != nil {
+				fmt.Println("Skipping email parser: ", err)
+				continue
+			}
+			emailParsers = append(emailParsers, compiled)
+		}
+	})
+	return emailParsers
+}
+
+func renderParserTemplate(tmpl *template.Template, fields map[string]string) string {
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, fields); err != nil {
+		return ""
+	}
+	return strings.Join(strings.Fields(sb.String()), " ")
+}
+
+// Add the named groups of a regex's first match to the fields.
+func addMatchFields(fields map[string]string, regex *regexp.Regexp, text string) bool {
+	match := regex.FindStringSubmatch(text)
+	if match == nil {
+		return false
+	}
+	for i, name := range regex.SubexpNames() {
+		if name != "" && match[i] != "" {
+			fields[name] = strings.TrimSpace(match[i])
+		}
+	}
+	return true
+}
+
+// Whether a sender matches one of a parser's patterns: a full address, a domain
+// written "@example.com" or one of its subdomains, or a mailbox name written
+// "jenkins@" on any domain.
+func matchesParserSender(sender *mail.Address, patterns []string) bool {
+	if sender == nil {
+		return false
+	}
+	address := strings.ToLower(sender.Address)
+	local, domain, ok := strings.Cut(address, "@")
+	if !ok {
+		return false
+	}
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		switch {
+		case pattern == "":
+		case strings.HasPrefix(pattern, "@"):
+			if domain == pattern[1:] || strings.HasSuffix(domain, "."+pattern[1:]) {
+				return true
+			}
+		case strings.HasSuffix(pattern, "@"):
+			if local == strings.TrimSuffix(pattern, "@") {
+				return true
+			}
+		case address == pattern:
+			return true
+		}
+	}
+	return false
+}
+
+// Run a parser over an email. Returns false when the email does not match or
+// the summary comes out empty.
+func (parser compiledParser) parse(email Email) (EmailAnalysis, bool) {
+	if len(parser.Senders) > 0 && !matchesParserSender(email.sender, parser.Senders) {
+		return EmailAnalysis{}, false
+	}
+
+	fields := map[string]string{"Subject": email.subject, "Sender": email.from}
+	if email.sender != nil {
+		fields["SenderEmail"] = email.sender.Address
+		if email.sender.Name != "" {
+			fields["Sender"] = email.sender.Name
+		}
+	}
+	if parser.subject != nil && !addMatchFields(fields, parser.subject, email.subject) {
+		return EmailAnalysis{}, false
+	}
+
+	text := email.subject + "\n" + strings.Join(email.body, "\n")
+	for _, pattern := range parser.patterns {
+		addMatchFields(fields, pattern, text)
+	}
+	if len(parser.Selectors) > 0 && email.html != "" {
+		if doc, err := html.Parse(strings.NewReader(email.html)); err == nil {
+			for field, selector := range parser.Selectors {
+				if value := selectText(doc, selector); value != "" {
+					fields[field] = value
+				}
+			}
+		}
+	}
+
+	analysis := EmailAnalysis{
+		Summary:     renderParserTemplate(parser.summary, fields),
+		ActionItems: []ActionItem{},
+		Categories:  parser.Categories,
+		NeedsReply:  parser.NeedsReply,
+	}
+	if analysis.Summary == "" {
+		return EmailAnalysis{}, false
+	}
+	for i, item := range parser.ActionItems {
+		if item.When != "" && fields[item.When] == "" {
+			continue
+		}
+		task := renderParserTemplate(parser.tasks[i], fields)
+		if task == "" {
+			continue
+		}
+		due := renderParserTemplate(parser.dues[i], fields)
+		if _, err := time.Parse("2006-01-02", due); err != nil {
+			due = ""
+		}
+		analysis.ActionItems = append(analysis.ActionItems, ActionItem{Task: task, Due: due})
+	}
+	return analysis, true
+}
+
+// Analyze an email with the first parser that handles it, returning its name.
+func parseKnownEmail(email Email) (EmailAnalysis, string, bool) {
+	for _, parser := range getEmailParsers() {
+		if analysis, ok := parser.parse(email); ok {
+			return analysis, parser.Name, true
+		}
+	}
+	return EmailAnalysis{}, "", false
+}
+
+// One step of a selector: a tag, id, classes and attribute conditions, e.g.
+// a.button[href^=https].
+type simpleSelector struct {
+	tag     string
+	id      string
+	classes []string
+	attrs   []attrCondition
+}
+
+type attrCondition struct {
+	name, op, value string
+}
+
+var (
+	selectorStepRegex = regexp.MustCompile(`^([a-zA-Z0-9]*|\*)((?:[.#][\w-]+|\[[^\]]+\])*)$`)
+	selectorPartRegex = regexp.MustCompile(`[.#][\w-]+|\[[^\]]+\]`)
+	attrRegex         = regexp.MustCompile(`^\[\s*([\w-]+)\s*(?:([*^$]?=)\s*"?([^"]*?)"?\s*)?\]$`)
+)
+
+// Parse a selector made of simple selectors separated by spaces, each matching
+// a descendant of the previous one.
+func parseSelector(selector string) ([]simpleSelector, error) {
+	selector, _ = splitSelectorAttr(selector)
+	var steps []simpleSelector
+	for _, step := range strings.Fields(selector) {
+		match := selectorStepRegex.FindStringSubmatch(step)
+		if match == nil {
+			return nil, fmt.Errorf("unsupported selector %q", step)
+		}
+		simple := simpleSelector{tag: strings.ToLower(strings.TrimPrefix(match[1], "*"))}
+		for _, part := range selectorPartRegex.FindAllString(match[2], -1) {
+			switch part[0] {
+			case '.':
+				simple.classes = append(simple.classes, part[1:])
+			case '#':
+				simple.id = part[1:]
+			case '[':
+				attr := attrRegex.FindStringSubmatch(part)
+				if attr == nil {
+					return nil, fmt.Errorf("unsupported attribute condition %q", part)
+				}
+				simple.attrs = append(simple.attrs, attrCondition{strings.ToLower(attr[1]), attr[2], attr[3]})
+			}
+		}
+		steps = append(steps, simple)
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("empty selector")
+	}
+	return steps, nil
+}
+
+// Split "a.button@href" into the selector and the attribute to read, "" for the text.
+func splitSelectorAttr(selector string) (string, string) {
+	i := strings.LastIndex(selector, "@")
+	if i == -1 || i < strings.LastIndex(selector, "]") {
+		return selector, ""
+	}
+	return selector[:i], strings.TrimSpace(selector[i+1:])
+}
+
+func nodeAttr(node *html.Node, name string) (string, bool) {
+	for _, attr := range node.Attr {
+		if attr.Key == name {
+			return attr.Val, true
+		}
+	}
+	return "", false
+}
+
+func (s simpleSelector) matches(node *html.Node) bool {
+	if node.Type != html.ElementNode || (s.tag != "" && node.Data != s.tag) {
+		return false
+	}
+	if s.id != "" {
+		if id, _ := nodeAttr(node, "id"); id != s.id {
+			return false
+		}
+	}
+	if len(s.classes) > 0 {
+		class, _ := nodeAttr(node, "class")
+		classes := strings.Fields(class)
+		for _, want := range s.classes {
+			found := false
+			for _, have := range classes {
+				if have == want {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+	for _, cond := range s.attrs {
+		value, ok := nodeAttr(node, cond.name)
+		if !ok {
+			return false
+		}
+		switch cond.op {
+		case "=":
+			ok = value == cond.value
+		case "*=":
+			ok = strings.Contains(value, cond.value)
+		case "^=":
+			ok = strings.HasPrefix(value, cond.value)
+		case "$=":
+			ok = strings.HasSuffix(value, cond.value)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// The first element matching all the steps, each inside the one before.
+func selectNode(node *html.Node, steps []simpleSelector) *html.Node {
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		if steps[0].matches(child) {
+			if len(steps) == 1 {
+				return child
+			}
+			if found := selectNode(child, steps[1:]); found != nil {
+				return found
+			}
+		}
+		if found := selectNode(child, steps); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// The text of the first element a selector matches, or its attribute when the
+// selector ends with @name.
+func selectText(doc *html.Node, selector string) string {
+	steps, err := parseSelector(selector)
+	if err != nil {
+		return ""
+	}
+	node := selectNode(doc, steps)
+	if node == nil {
+		return ""
+	}
+	if _, attr := splitSelectorAttr(selector); attr != "" {
+		value, _ := nodeAttr(node, attr)
+		return strings.TrimSpace(value)
+	}
+
+	var sb strings.Builder
+	var collect func(node *html.Node)
+	collect = func(node *html.Node) {
+		if node.Type == html.TextNode {
+			sb.WriteString(node.Data + " ")
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			collect(child)
+		}
+	}
+	collect(node)
+	return strings.Join(strings.Fields(sb.String()), " ")
+}
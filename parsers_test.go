@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/mail"
+	"testing"
+)
+
+func TestParseKnownEmail(t *testing.T) {
+	setConfiguration(Configuration{})
+
+	tests := []struct {
+		name    string
+		from    string
+		subject string
+		body    string
+		parser  string
+		items   int
+	}{
+		{"github failure", "GitHub <notifications@github.com>", "[octo/repo] Run failed: CI - main (abc1234)", "", "github-actions", 1},
+		{"github failure from a person", "bob@acme.com", "[octo/repo] Run failed: CI - main (abc1234)", "", "", 0},
+		{"gitlab failure", "GitLab <gitlab@mg.gitlab.com>", "Failed pipeline for main | my-project | abc123", "", "gitlab-pipeline", 1},
+		{"self-hosted gitlab", "gitlab@git.acme.com", "Failed pipeline for main | my-project | abc123", "", "gitlab-pipeline", 1},
+		{"gitlab subject from a person", "bob@acme.com", "Failed pipeline for main | my-project", "", "", 0},
+		{"jenkins failure", "jenkins@ci.acme.com", "Build failed in Jenkins: deploy #42", "", "jenkins", 1},
+		{"jenkins subject forwarded", "bob@acme.com", "Build failed in Jenkins: deploy #42", "", "", 0},
+		{"jira assigned", "Alex (Jira) <jira@acme.atlassian.net>", "[JIRA] (PROJ-12) Fix login", "Alex assigned this issue to you", "jira", 1},
+		{"jira mention", "jira@acme.atlassian.net", "[JIRA] Alex mentioned you on PROJ-13: Crash", "", "jira", 1},
+		{"jira update", "jira@acme.atlassian.net", "[JIRA] (PROJ-14) Tidy logs", "Status changed to Done", "jira", 0},
+		{"jira subject from a person", "bob@acme.com", "[JIRA] (PROJ-12) can you look at this?", "", "", 0},
+		{"calendar invitation", "Ann <calendar-notification@google.com>", "Invitation: Standup @ Mon Oct 20, 2026 9am - 9:15am (PDT) (me@x.com)", "", "calendar-invitation", 1},
+		{"invitation from a person", "bob@acme.com", "Invitation: Lunch @ Friday", "", "", 0},
+		{"calendar cancellation", "calendar-notification@google.com", "Canceled event: Standup @ Mon Oct 20, 2026 9am (me@x.com)", "", "calendar-cancellation", 0},
+		{"calendar response", "Bob <calendar-notification@google.com>", "Accepted: Standup @ Mon Oct 20, 2026 9am (me@x.com)", "", "calendar-response", 0},
+		{"amazon shipped", "shipment-tracking@amazon.com", "Shipped: \"USB cable\" and 1 more item", "Tracking number: TBA123456789000", "shipping", 0},
+		{"order shipped", "orders@shop.app", "Your order #1234 has shipped", "Carrier: UPS Tracking number: 1Z999AA10123456784", "shipping", 0},
+		{"package out for delivery", "mcinfo@ups.com", "Your package is out for delivery", "", "shipping", 0},
+		{"contract shipped", "bob@acme.com", "The contract has shipped to legal - please sign by Friday", "", "", 0},
+		{"retailer mail that is not a shipment", "deals@amazon.com", "Deals we shipped just for you", "", "", 0},
+		{"retailer question", "help@etsy.com", "Question about your order", "", "", 0},
+		{"free-form mail", "bob@acme.com", "Lunch?", "", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			email := Email{subject: tt.subject, from: tt.from, sender: parseAddress(tt.from), body: []string{tt.body}}
+			analysis, parser, ok := parseKnownEmail(email)
+			if parser != tt.parser || ok != (tt.parser != "") {
+				t.Fatalf("parser = %q, %v, want %q", parser, ok, tt.parser)
+			}
+			if ok && analysis.Summary == "" {
+				t.Errorf("empty summary")
+			}
+			if len(analysis.ActionItems) != tt.items {
+				t.Errorf("got %d action items %v, want %d", len(analysis.ActionItems), analysis.ActionItems, tt.items)
+			}
+		})
+	}
+}
+
+func TestMatchesParserSender(t *testing.T) {
+	patterns := []string{"notifications@github.com", "@atlassian.net", "jenkins@"}
+	tests := []struct {
+		address string
+		want    bool
+	}{
+		{"notifications@github.com", true},
+		{"Notifications@GitHub.com", true},
+		{"noreply@github.com", false},
+		{"jira@acme.atlassian.net", true},
+		{"jira@atlassian.net", true},
+		{"jira@notatlassian.net", false},
+		{"jenkins@ci.acme.com", true},
+		{"jenkinsbot@ci.acme.com", false},
+	}
+	for _, tt := range tests {
+		if got := matchesParserSender(&mail.Address{Address: tt.address}, patterns); got != tt.want {
+			t.Errorf("matchesParserSender(%q) = %v, want %v", tt.address, got, tt.want)
+		}
+	}
+	if matchesParserSender(nil, patterns) {
+		t.Errorf("matched a nil sender")
+	}
+}
+
+func TestSelectText(t *testing.T) {
+	parser, err := compileParser(EmailParser{
+		Name:      "ci",
+		Senders:   []string{"@acme.com"},
+		Selectors: map[string]string{"status": "table td.status", "url": "a[href*=/runs/]@href"},
+		Summary:   "Build {{.status}} {{.url}}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	email := Email{
+		subject: "Build done",
+		sender:  &mail.Address{Address: "ci@acme.com"},
+		html:    `<a href="https://acme.com">logo</a><table><tr><td class="x status">passed</td></tr></table><a href="https://ci/runs/5">run</a>`,
+	}
+	analysis, ok := parser.parse(email)
+	if !ok || analysis.Summary != "Build passed https://ci/runs/5" {
+		t.Errorf("got %q, %v", analysis.Summary, ok)
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	warningPhishing       = "Possible phishing"
+	warningAnalysisFailed = "Analysis failed"
+
+	suspiciousScore = 50
+	// Added when the LLM judges an email suspicious, enough to flag it alone since
+	// scams such as gift card requests from a free mail address pass every header check
+	modelJudgmentScore = suspiciousScore
+	// Most links listed in the phishing prompt
+	maxPromptLinks = 20
+)
+
+// Domains commonly impersonated in phishing, checked for lookalikes along with
+// the trustedDomains setting, the VIP senders and the user's own domain.
+var impersonatedDomains = []string{
+	"paypal.com", "apple.com", "icloud.com", "microsoft.com", "office.com", "outlook.com",
+	"google.com", "gmail.com", "amazon.com", "netflix.com", "facebook.com", "instagram.com",
+	"linkedin.com", "dropbox.com", "docusign.com", "docusign.net", "chase.com", "wellsfargo.com",
+	"bankofamerica.com", "citi.com", "dhl.com", "fedex.com", "ups.com", "usps.com", "irs.gov",
+}
+
+var (
+	authResultRegex = regexp.MustCompile(`(?i)\b(spf|dkim|dmarc)\s*=\s*([a-z]+)`)
+	domainRegex     = regexp.MustCompile(`(?i)\b(?:[a-z0-9](?:[a-z0-9-]*[a-z0-9])?\.)+[a-z]{2,}\b`)
+)
+
+// Options of the Warning property.
+func warningOptions() []SelectOption {
+	return []SelectOption{{Name: warningPhishing, Color: "red"}, {Name: warningAnalysisFailed, Color: "orange"}}
+}
+
+// A link in an email's HTML, with the text it is shown as.
+type EmailLink struct {
+	Text string
+	Href string
+}
+
+// Collect the links of an HTML body.
+func extractLinks(htmlContent string) []EmailLink {
+	doc, err := html.Parse(strings.NewReader(htmlContent))
+	if err != nil {
+		return nil
+	}
+
+	var links []EmailLink
+	var text func(node *html.Node) string
+	text = func(node *html.Node) string {
+		if node.Type == html.TextNode {
+			return node.Data
+		}
+		var sb strings.Builder
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			sb.WriteString(text(child))
+		}
+		return sb.String()
+	}
+	var traverse func(node *html.Node)
+	traverse = func(node *html.Node) {
+		if node.Type == html.ElementNode && node.Data == "a" {
+			for _, attr := range node.Attr {
+				if attr.Key == "href" && strings.TrimSpace(attr.Val) != "" {
+					links = append(links, EmailLink{
+						Text: strings.Join(strings.Fields(text(node)), " "),
+						Href: strings.TrimSpace(attr.Val),
+					})
+				}
+			}
+			return
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			traverse(child)
+		}
+	}
+	traverse(doc)
+	return links
+}
+
+// The registrable part of a host name, e.g. example.co.uk for mail.example.co.uk.
+func registrableDomain(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if domain, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		return domain
+	}
+	return host
+}
+
+// The label a domain is known by, e.g. paypal for paypal.co.uk.
+func domainLabel(domain string) string {
+	suffix, _ := publicsuffix.PublicSuffix(domain)
+	return strings.TrimSuffix(strings.TrimSuffix(domain, suffix), ".")
+}
+
+// The host a link or link text points to, "" when it is not a web address.
+func linkHost(link string) string {
+	link = strings.TrimSpace(link)
+	if !strings.Contains(link, "://") {
+		link = "http://" + link
+	}
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// The SPF, DKIM and DMARC checks that failed in an Authentication-Results header.
+// A method counts as failed when none of its results passed.
+func failedAuthentication(results string) []string {
+	passed := make(map[string]bool)
+	failed := make(map[string]string)
+	for _, match := range authResultRegex.FindAllStringSubmatch(results, -1) {
+		method, result := strings.ToLower(match[1]), strings.ToLower(match[2])
+		switch result {
+		case "pass":
+			passed[method] = true
+		case "fail", "softfail", "permerror":
+			failed[method] = result
+		}
+	}
+
+	var failures []string
+	for _, method := range []string{"dmarc", "spf", "dkim"} {
+		if result, ok := failed[method]; ok && !passed[method] {
+			failures = append(failures, method+"="+result)
+		}
+	}
+	return failures
+}
+
+// Normalize characters that are easily mistaken for each other in domain names.
+var homoglyphs = strings.NewReplacer("rn", "m", "vv", "w", "0", "o", "1", "l", "i", "l", "5", "s", "3", "e")
+
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(rb)]
+}
+
+// The domains lookalikes are checked against.
+func protectedDomains(email Email) []string {
+	domains := append([]string{}, impersonatedDomains...)
+	domains = append(domains, getConfiguration().TrustedDomains...)
+	for _, sender := range getConfiguration().VIPSenders {
+		domains = append(domains, addressDomain(sender))
+	}
+	domains = append(domains, addressDomain(email.userAddress))
+
+	var protected []string
+	seen := make(map[string]bool)
+	for _, domain := range domains {
+		domain = registrableDomain(strings.TrimPrefix(strings.TrimSpace(domain), "@"))
+		if domain == "" || seen[domain] {
+			continue
+		}
+		seen[domain] = true
+		protected = append(protected, domain)
+	}
+	return protected
+}
+
+// The protected domain a sender's domain imitates, "" when it imitates none.
+// Catches swapped look-alike characters, the brand name with words added
+// (paypal-billing.com), the real domain used as a subdomain
+// (paypal.com.example.net) and one-letter typos. typo reports a match on a
+// one-letter difference alone, which legitimate domains such as mail.com and
+// cloud.com share with gmail.com and icloud.com, so it is only a weak signal.
+func lookalikeOf(host string, protected []string) (imitated string, typo bool) {
+	host = strings.ToLower(host)
+	domain := registrableDomain(host)
+	label := domainLabel(domain)
+	for _, trusted := range protected {
+		if domain == trusted {
+			return "", false
+		}
+	}
+	for _, trusted := range protected {
+		trustedLabel := domainLabel(trusted)
+		switch {
+		case strings.HasPrefix(host, trusted+".") || strings.Contains(host, "."+trusted+"."):
+			return trusted, false
+		case len(trustedLabel) < 4 || label == trustedLabel:
+			// Too short to compare, or the same brand on another top level domain
+		case homoglyphs.Replace(label) == homoglyphs.Replace(trustedLabel):
+			return trusted, false
+		case strings.HasPrefix(label, trustedLabel+"-") || strings.HasSuffix(label, "-"+trustedLabel):
+			return trusted, false
+		case imitated == "" && len(trustedLabel) >= 5 && levenshtein(label, trustedLabel) == 1:
+			imitated = trusted
+		}
+	}
+	return imitated, imitated != ""
+}
+
+// Words that go with a brand's name in the display names of its own mail, as in
+// "PayPal Service" or "The Microsoft account team".
+var brandSenderWords = map[string]bool{
+	"the": true, "support": true, "service": true, "services": true, "customer": true,
+	"care": true, "help": true, "security": true, "account": true, "accounts": true,
+	"billing": true, "payments": true, "team": true, "alert": true, "alerts": true,
+	"notification": true, "notifications": true, "no": true, "reply": true,
+	"noreply": true, "info": true, "id": true, "online": true, "inc": true,
+}
+
+// Whether a display name reads like mail sent by a brand: its name alone or
+// with words such as "Support" or another brand's name ("Microsoft Office").
+// Names that merely contain a brand that is also an ordinary word, such as
+// "Apple Valley PTA" or "Chase Smith", do not.
+func namesBrand(name, label string, labels map[string]bool) bool {
+	words := strings.FieldsFunc(name, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	named := false
+	for _, word := range words {
+		switch {
+		case word == label:
+			named = true
+		case !brandSenderWords[word] && !labels[word]:
+			return false
+		}
+	}
+	return named
+}
+
+// The domain a display name claims when it is not the address's own, either by
+// containing an address or domain or by reading like a protected brand's sender.
+func displayNameMismatch(sender *mail.Address, protected []string) string {
+	name := strings.ToLower(sender.Name)
+	domain := registrableDomain(addressDomain(strings.ToLower(sender.Address)))
+	if name == "" || domain == "" {
+		return ""
+	}
+	for _, match := range domainRegex.FindAllString(name, -1) {
+		if claimed := registrableDomain(match); claimed != domain {
+			return claimed
+		}
+	}
+	labels := make(map[string]bool)
+	for _, trusted := range protected {
+		labels[domainLabel(trusted)] = true
+	}
+	for _, trusted := range protected {
+		label := domainLabel(trusted)
+		// The same brand on another top level domain, such as amazon.de, is fine
+		if len(label) < 4 || label == domainLabel(domain) {
+			continue
+		}
+		if namesBrand(name, label, labels) {
+			return trusted
+		}
+	}
+	return ""
+}
+
+// Links whose text shows one web address while they lead to another site, and
+// links straight to an IP address.
+func suspiciousLinks(links []EmailLink) (string, string) {
+	var mismatch, ipLink string
+	for _, link := range links {
+		host := linkHost(link.Href)
+		if host == "" {
+			continue
+		}
+		if ipLink == "" && net.ParseIP(host) != nil {
+			ipLink = host
+		}
+		if mismatch != "" || strings.ContainsAny(link.Text, " \t") || !domainRegex.MatchString(link.Text) {
+			continue
+		}
+		shown := linkHost(link.Text)
+		if shown != "" && registrableDomain(shown) != registrableDomain(host) {
+			mismatch = fmt.Sprintf("link shown as %s leads to %s", shown, host)
+		}
+	}
+	return mismatch, ipLink
+}
+
+func formatLinksForPrompt(links []EmailLink) string {
+	var sb strings.Builder
+	for i, link := range links {
+		if i == maxPromptLinks {
+			fmt.Fprintf(&sb, "(%d more links)\n", len(links)-maxPromptLinks)
+			break
+		}
+		fmt.Fprintf(&sb, "- %q: %s\n", link.Text, link.Href)
+	}
+	if sb.Len() == 0 {
+		return "(none)"
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+func generatePhishingPrompt(email Email, header string) RenderedPrompt {
+	data := emailPromptData(email, firstChunk(header, email.body))
+	data["Links"] = formatLinksForPrompt(email.links)
+	return renderPrompt("phishing", data)
+}
+
+// The LLM's judgment of whether an email is phishing.
+type PhishingJudgment struct {
+	Suspicious bool   `json:"Suspicious"`
+	Reason     string `json:"Reason"`
+}
+
+func parsePhishingJudgment(jsonString string) (PhishingJudgment, error) {
+	var response PhishingJudgment
+	if err := json.Unmarshal([]byte(jsonString), &response); err != nil {
+		return PhishingJudgment{}, err
+	}
+	response.Reason = strings.TrimSpace(response.Reason)
+	return response, nil
+}
+
+// Score how likely an email is to be phishing by adding up the failed sender
+// authentication, a display name or domain imitating someone else, misleading
+// links and the LLM's judgment. The LLM is asked about every email the other
+// signals do not already flag. Returns whether it is suspicious and why.
+func assessPhishing(email Email, header string) (bool, []string) {
+	score := 0
+	var reasons []string
+
+	if failures := failedAuthentication(email.authResults); len(failures) > 0 {
+		for _, failure := range failures {
+			switch {
+			case strings.HasPrefix(failure, "dmarc="):
+				score += 30
+			case strings.HasSuffix(failure, "=softfail"):
+				score += 10
+			default:
+				score += 20
+			}
+		}
+		reasons = append(reasons, "failed "+strings.Join(failures, ", "))
+	}
+
+	protected := protectedDomains(email)
+	var host, typoOf string
+	if email.sender != nil {
+		if claimed := displayNameMismatch(email.sender, protected); claimed != "" {
+			score += 25
+			reasons = append(reasons, fmt.Sprintf("sender name suggests %s but the address is %s", claimed, email.sender.Address))
+		}
+		host = addressDomain(strings.ToLower(email.sender.Address))
+		imitated, typo := lookalikeOf(host, protected)
+		if imitated != "" && !typo {
+			score += 40
+			reasons = append(reasons, fmt.Sprintf("sender domain %s looks like %s", host, imitated))
+		} else if strings.HasPrefix(host, "xn--") || strings.Contains(host, ".xn--") {
+			score += 20
+			reasons = append(reasons, fmt.Sprintf("sender domain %s uses look-alike characters", host))
+		}
+		if typo {
+			typoOf = imitated
+		}
+	}
+
+	mismatch, ipLink := suspiciousLinks(email.links)
+	if mismatch != "" {
+		score += 30
+		reasons = append(reasons, mismatch)
+	}
+	if ipLink != "" {
+		score += 15
+		reasons = append(reasons, "link to the IP address "+ipLink)
+	}
+	// A domain one letter off a protected one only counts along with another signal
+	if typoOf != "" && score > 0 {
+		score += 40
+		reasons = append(reasons, fmt.Sprintf("sender domain %s is one letter off %s", host, typoOf))
+	}
+
+	if score >= suspiciousScore {
+		return true, reasons
+	}
+
+	judgment, err := completeJSON(generatePhishingPrompt(email, header), parsePhishingJudgment)
+	if err != nil {
+		fmt.Println("Error parsing phishing judgment: ", err)
+	} else if judgment.Suspicious {
+		score += modelJudgmentScore
+		if judgment.Reason != "" {
+			reasons = append(reasons, judgment.Reason)
+		} else {
+			reasons = append(reasons, "judged suspicious by the model")
+		}
+	}
+
+	return score >= suspiciousScore, reasons
+}
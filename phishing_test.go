@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"net/mail"
+	"os"
+	"testing"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// A model that gives the same answer to every prompt.
+type fakeLLM struct {
+	answer string
+}
+
+func (f fakeLLM) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return f.answer, nil
+}
+
+func (f fakeLLM) Generate(ctx context.Context, prompts []string, options ...llms.CallOption) ([]*llms.Generation, error) {
+	generations := make([]*llms.Generation, len(prompts))
+	for i := range prompts {
+		generations[i] = &llms.Generation{Text: f.answer}
+	}
+	return generations, nil
+}
+
+// Answer every prompt with answer, running in a temporary directory so the cache
+// and usage files are not left behind.
+func useFakeLLM(t *testing.T, answer string) {
+	t.Helper()
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(dir) })
+
+	setConfiguration(Configuration{Provider: providerLocal})
+	backend := llmBackends()[0]
+	llmClientsMu.Lock()
+	llmClients[backend.Provider+"/"+backend.Model] = fakeLLM{answer: answer}
+	llmClientsMu.Unlock()
+}
+
+func TestLookalikeOf(t *testing.T) {
+	setConfiguration(Configuration{})
+	protected := protectedDomains(Email{userAddress: "me@acme.com"})
+	tests := []struct {
+		host     string
+		imitated string
+		typo     bool
+	}{
+		{"paypal.com", "", false},
+		{"mail.paypal.com", "", false},
+		{"paypa1.com", "paypal.com", false},
+		{"rnicrosoft.com", "microsoft.com", false},
+		{"paypal-billing.com", "paypal.com", false},
+		{"paypal.com.example.net", "paypal.com", false},
+		{"acme-payroll.com", "acme.com", false},
+		{"paypall.com", "paypal.com", true},
+		// Legitimate domains one letter off a protected one are only weak matches
+		{"mail.com", "gmail.com", true},
+		{"email.com", "gmail.com", true},
+		{"cloud.com", "icloud.com", true},
+		{"amazon.de", "", false},
+		{"example.org", "", false},
+	}
+	for _, tt := range tests {
+		imitated, typo := lookalikeOf(tt.host, protected)
+		if imitated != tt.imitated || typo != tt.typo {
+			t.Errorf("lookalikeOf(%q) = %q, %v, want %q, %v", tt.host, imitated, typo, tt.imitated, tt.typo)
+		}
+	}
+}
+
+func TestAssessPhishingTypoDomain(t *testing.T) {
+	useFakeLLM(t, `{"Suspicious":false,"Reason":""}`)
+	tests := []struct {
+		name        string
+		from        string
+		authResults string
+		suspicious  bool
+	}{
+		{"legitimate one-letter domain", "Newsletter <news@mail.com>", "spf=pass dkim=pass dmarc=pass", false},
+		{"typo domain failing dmarc", "Support <support@paypall.com>", "spf=pass dkim=pass dmarc=fail", true},
+		{"display name claiming a brand", "PayPal <service@paypal-billing.com>", "spf=pass dkim=pass dmarc=pass", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender, err := mail.ParseAddress(tt.from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			email := Email{from: tt.from, sender: sender, authResults: tt.authResults}
+			if suspicious, reasons := assessPhishing(email, ""); suspicious != tt.suspicious {
+				t.Errorf("suspicious = %v (%v), want %v", suspicious, reasons, tt.suspicious)
+			}
+		})
+	}
+}
+
+func TestAssessPhishingModelJudgment(t *testing.T) {
+	scam := Email{
+		from:        "Jane Doe <jane.doe.ceo@gmail.com>",
+		subject:     "Quick favor",
+		body:        []string{"Are you at your desk? I need you to buy five $200 gift cards for a client right away and send me the codes. Keep this between us."},
+		authResults: "spf=pass dkim=pass dmarc=pass",
+	}
+	sender, err := mail.ParseAddress(scam.from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scam.sender = sender
+
+	useFakeLLM(t, `{"Suspicious":true,"Reason":"Asks for gift card codes while pressing for secrecy"}`)
+	suspicious, reasons := assessPhishing(scam, "")
+	if !suspicious || len(reasons) != 1 || reasons[0] != "Asks for gift card codes while pressing for secrecy" {
+		t.Errorf("content-only scam: suspicious = %v (%v), want true with the model's reason", suspicious, reasons)
+	}
+
+	useFakeLLM(t, `{"Suspicious":false,"Reason":"An ordinary request"}`)
+	if suspicious, reasons := assessPhishing(scam, ""); suspicious {
+		t.Errorf("suspicious = true (%v) although nothing is suspicious", reasons)
+	}
+}
+
+func TestDisplayNameMismatch(t *testing.T) {
+	setConfiguration(Configuration{})
+	protected := protectedDomains(Email{userAddress: "me@acme.com"})
+	tests := []struct {
+		from    string
+		claimed string
+	}{
+		{"PayPal <service@paypal-billing.com>", "paypal.com"},
+		{"PayPal Customer Service <service@example.net>", "paypal.com"},
+		{"The Microsoft account team <team@example.net>", "microsoft.com"},
+		{"Microsoft Office <office@example.net>", "microsoft.com"},
+		{"Apple Support <no-reply@example.net>", "apple.com"},
+		{`"support@paypal.com" <support@example.net>`, "paypal.com"},
+		{"PayPal <service@paypal.com>", ""},
+		{"Amazon.de <store@amazon.de>", ""},
+		{"Office Hours <hours@example.net>", ""},
+		{"Outlook Weekly <news@example.net>", ""},
+		{"Apple Valley PTA <pta@example.net>", ""},
+		{"Chase Smith <chase@example.net>", ""},
+		{"PayPalFans Weekly <news@example.net>", ""},
+	}
+	for _, tt := range tests {
+		sender, err := mail.ParseAddress(tt.from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claimed := displayNameMismatch(sender, protected); claimed != tt.claimed {
+			t.Errorf("displayNameMismatch(%q) = %q, want %q", tt.from, claimed, tt.claimed)
+		}
+	}
+}
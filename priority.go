@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+const (
+	priorityHigh   = "High"
+	priorityMedium = "Medium"
+	priorityLow    = "Low"
+
+	highPriorityScore   = 60
+	mediumPriorityScore = 35
+)
+
+// Priority options in the order a Notion sort on the property should list them.
+func priorityOptions() []SelectOption {
+	return []SelectOption{
+		{Name: priorityHigh, Color: "red"},
+		{Name: priorityMedium, Color: "yellow"},
+		{Name: priorityLow, Color: "gray"},
+	}
+}
+
+var deadlineRegex = regexp.MustCompile(`(?i)\b(deadline|due (by|on|date)|asap|urgent|eod|end of (the )?day|cob|by (today|tonight|tomorrow|monday|tuesday|wednesday|thursday|friday|saturday|sunday|noon|the end of)|before \d{1,2}(:\d{2})?\s*(am|pm)|by \d{1,2}[/.-]\d{1,2})\b`)
+
+var replyNeededRegex = regexp.MustCompile(`(?i)(\?|\b(please (let me know|confirm|reply|respond|advise|review|send)|can you|could you|would you|are you able|let me know)\b)`)
+
+func generatePriorityPrompt(email Email, header string) RenderedPrompt {
+	return renderPrompt("priority", emailPromptData(email, firstChunk(header, email.body)))
+}
+
+// The LLM's judgment of how urgent an email is, from 1 to 5.
+type Urgency struct {
+	Urgency int    `json:"Urgency"`
+	Reason  string `json:"Reason"`
+}
+
+func parseUrgency(jsonString string) (Urgency, error) {
+	var response Urgency
+	if err := json.Unmarshal([]byte(jsonString), &response); err != nil {
+		return Urgency{}, err
+	}
+	if response.Urgency < 1 || response.Urgency > 5 {
+		return Urgency{}, fmt.Errorf("urgency %d out of range", response.Urgency)
+	}
+	response.Reason = strings.TrimSpace(response.Reason)
+	return response, nil
+}
+
+func containsAddress(addresses []*mail.Address, address string) bool {
+	for _, a := range addresses {
+		if strings.EqualFold(a.Address, address) {
+			return true
+		}
+	}
+	return false
+}
+
+// Score how much attention an email needs by adding up deterministic signals and
+// the LLM's urgency rating. Returns the priority and the reasons behind it.
+func scorePriority(email Email, header string) (string, string) {
+	score := 0
+	var reasons []string
+
+	if matchesSender(email.sender, getConfiguration().VIPSenders) {
+		score += 20
+		reasons = append(reasons, "VIP sender")
+	}
+
+	if email.userAddress != "" {
+		if containsAddress(email.recipients, email.userAddress) {
+			score += 10
+			reasons = append(reasons, "sent directly to you")
+		} else if containsAddress(email.cc, email.userAddress) {
+			score -= 5
+			reasons = append(reasons, "you are only in Cc")
+		}
+	}
+
+	if email.listID != "" {
+		score -= 10
+		reasons = append(reasons, "mailing list")
+	}
+
+	text := email.subject + "\n" + strings.Join(email.body, "\n")
+	if deadlineRegex.MatchString(text) {
+		score += 15
+		reasons = append(reasons, "mentions a deadline")
+	}
+
+	if hasLabel(email, "IMPORTANT") {
+		score += 10
+		reasons = append(reasons, "marked important by Gmail")
+	}
+	if hasLabel(email, "STARRED") {
+		score += 15
+		reasons = append(reasons, "starred")
+	}
+
+	// Fall back on phrasing when the analysis failed and needs_reply is unknown
+	if email.needsReply || email.draftLink != "" || (email.summary == "" && replyNeededRegex.MatchString(text)) {
+		score += 10
+		reasons = append(reasons, "needs a reply")
+	}
+
+	switch {
+	case email.parser != "":
+		// Emails from known systems are scored on the signals above alone
+		if len(email.actionItems) > 0 {
+			score += 20
+			reasons = append(reasons, "has action items")
+		}
+	case email.urgency > 0:
+		score += email.urgency * 10
+		if email.urgencyReason != "" {
+			reasons = append(reasons, email.urgencyReason)
+		}
+	case email.analysisError == "":
+		// A pinned analysis template that does not rate urgency, ask separately
+		urgency, err := completeJSON(generatePriorityPrompt(email, header), parseUrgency)
+		if err != nil {
+			fmt.Println("Error parsing urgency: ", err)
+		} else {
+			score += urgency.Urgency * 10
+			if urgency.Reason != "" {
+				reasons = append(reasons, urgency.Reason)
+			}
+		}
+	}
+
+	priority := priorityLow
+	switch {
+	case score >= highPriorityScore:
+		priority = priorityHigh
+	case score >= mediumPriorityScore:
+		priority = priorityMedium
+	}
+	return priority, strings.Join(reasons, "; ")
+}
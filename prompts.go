@@ -0,0 +1,343 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tmc/langchaingo/prompts"
+)
+
+const (
+	promptsDirName = "prompts"
+	defaultModel   = "mistralai/Mistral-7B-Instruct-v0.1"
+)
+
+// Copies of the prompt templates built into the binary, overridden by files in ./prompts
+//
+//go:embed prompts
+var defaultPrompts embed.FS
+
+// A versioned prompt template loaded from prompts/<Name>/<Version>.txt
+type PromptTemplate struct {
+	Name    string
+	Version string
+	System  string
+	User    string
+}
+
+// A prompt rendered for a model: the system and user messages, and the two
+// combined into the text the model is called with.
+type RenderedPrompt struct {
+	Name    string
+	Version string
+	System  string
+	User    string
+	Text    string
+	// The sender of the email the prompt is about, for the usage totals
+	Sender string
+}
+
+// How a model expects system and user messages to be laid out, and the marker
+// after which its answer starts when the inference API echoes the prompt back.
+type ChatFormat struct {
+	Render         func(system, user string) string
+	ResponseMarker string
+}
+
+var chatFormats = map[string]ChatFormat{
+	"mistral": {
+		// Mistral has no system role, the system message goes first in the instruction
+		Render: func(system, user string) string {
+			return "[INST] " + joinNonEmpty("\n\n", system, user) + " [/INST]"
+		},
+		ResponseMarker: "[/INST]",
+	},
+	"llama3": {
+		Render: func(system, user string) string {
+			var sb strings.Builder
+			sb.WriteString("<|begin_of_text|>")
+			if system != "" {
+				sb.WriteString("<|start_header_id|>system<|end_header_id|>\n\n" + system + "<|eot_id|>")
+			}
+			sb.WriteString("<|start_header_id|>user<|end_header_id|>\n\n" + user + "<|eot_id|>")
+			sb.WriteString("<|start_header_id|>assistant<|end_header_id|>\n\n")
+			return sb.String()
+		},
+		ResponseMarker: "<|start_header_id|>assistant<|end_header_id|>",
+	},
+	"chatml": {
+		Render: func(system, user string) string {
+			var sb strings.Builder
+			if system != "" {
+				sb.WriteString("<|im_start|>system\n" + system + "<|im_end|>\n")
+			}
+			sb.WriteString("<|im_start|>user\n" + user + "<|im_end|>\n")
+			sb.WriteString("<|im_start|>assistant\n")
+			return sb.String()
+		},
+		ResponseMarker: "<|im_start|>assistant",
+	},
+	"plain": {
+		Render: func(system, user string) string {
+			var sb strings.Builder
+			if system != "" {
+				sb.WriteString("System: " + system + "\n\n")
+			}
+			sb.WriteString("User: " + user + "\n\nAssistant:")
+			return sb.String()
+		},
+		ResponseMarker: "Assistant:",
+	},
+}
+
+func joinNonEmpty(sep string, parts ...string) string {
+	var nonEmpty []string
+	for _, part := range parts {
+		if part != "" {
+			nonEmpty = append(nonEmpty, part)
+		}
+	}
+	return strings.Join(nonEmpty, sep)
+}
+
+// The model Jot summarizes with.
+func modelName() string {
+	if model := getConfiguration().Model; model != "" {
+		return model
+	}
+	return defaultModel
+}
+
+// The chat format for the configured model, guessed from its name unless set explicitly.
+func chatFormatName() string {
+	if name := getConfiguration().ChatFormat; name != "" {
+		return name
+	}
+	return guessChatFormat(modelName())
+}
+
+// The chat format a model most likely expects, from its name.
+func guessChatFormat(model string) string {
+	model = strings.ToLower(model)
+	switch {
+	case strings.Contains(model, "llama-3"), strings.Contains(model, "llama3"):
+		return "llama3"
+	case strings.Contains(model, "mistral"), strings.Contains(model, "mixtral"):
+		return "mistral"
+	case strings.Contains(model, "qwen"), strings.Contains(model, "hermes"), strings.Contains(model, "chatml"):
+		return "chatml"
+	}
+	return "plain"
+}
+
+func lookupChatFormat(name string) (ChatFormat, error) {
+	format, ok := chatFormats[name]
+	if !ok {
+		return ChatFormat{}, fmt.Errorf("unknown chat format %q, expected one of mistral, llama3, chatml or plain", name)
+	}
+	return format, nil
+}
+
+func getChatFormat() ChatFormat {
+	format, err := lookupChatFormat(chatFormatName())
+	if err != nil {
+		log.Fatal(err)
+	}
+	return format
+}
+
+// Parse a template file into its [system] and [user] sections. A file without
+// section markers is used as the user message.
+func parsePromptTemplate(name, version, content string) PromptTemplate {
+	template := PromptTemplate{Name: name, Version: version}
+
+	var current *string
+	var lines []string
+	flush := func() {
+		if current != nil {
+			*current = strings.TrimSpace(strings.Join(lines, "\n"))
+		}
+		lines = nil
+	}
+
+	for _, line := range strings.Split(content, "\n") {
+		switch strings.TrimSpace(line) {
+		case "[system]":
+			flush()
+			current = &template.System
+		case "[user]":
+			flush()
+			current = &template.User
+		default:
+			lines = append(lines, line)
+		}
+	}
+	if current == nil {
+		current = &template.User
+	}
+	flush()
+	return template
+}
+
+// The available versions of a prompt, from ./prompts and the built in copies, oldest first.
+func promptVersions(name string) []string {
+	seen := make(map[string]bool)
+	var versions []string
+	add := func(entries []fs.DirEntry) {
+		for _, entry := range entries {
+			version := strings.TrimSuffix(entry.Name(), ".txt")
+			if entry.IsDir() || version == entry.Name() || seen[version] {
+				continue
+			}
+			seen[version] = true
+			versions = append(versions, version)
+		}
+	}
+
+	if entries, err := os.ReadDir(path.Join(promptsDirName, name)); err == nil {
+		add(entries)
+	}
+	if entries, err := defaultPrompts.ReadDir(path.Join(promptsDirName, name)); err == nil {
+		add(entries)
+	}
+
+	versionNumber := func(version string) int {
+		n, _ := strconv.Atoi(strings.TrimPrefix(version, "v"))
+		return n
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versionNumber(versions[i]) < versionNumber(versions[j])
+	})
+	return versions
+}
+
+// Load a prompt template, preferring the version pinned in the settings and
+// otherwise the newest one. Files in ./prompts take precedence over built in ones.
+func loadPromptTemplate(name string) (PromptTemplate, error) {
+	version := getConfiguration().PromptVersions[name]
+	if version == "" {
+		versions := promptVersions(name)
+		if len(versions) == 0 {
+			return PromptTemplate{}, fmt.Errorf("no prompt template named %q", name)
+		}
+		version = versions[len(versions)-1]
+	}
+
+	file := path.Join(promptsDirName, name, version+".txt")
+	content, err := os.ReadFile(file)
+	if err != nil {
+		content, err = defaultPrompts.ReadFile(file)
+		if err != nil {
+			return PromptTemplate{}, fmt.Errorf("unable to read prompt template %s: %v", file, err)
+		}
+	}
+	return parsePromptTemplate(name, version, string(content)), nil
+}
+
+var (
+	promptTemplates   = make(map[string]PromptTemplate)
+	promptTemplatesMu sync.Mutex
+)
+
+// Load a prompt template once per run and pinned version.
+func getPromptTemplate(name string) PromptTemplate {
+	promptTemplatesMu.Lock()
+	defer promptTemplatesMu.Unlock()
+
+	key := name + "/" + getConfiguration().PromptVersions[name]
+	if template, ok := promptTemplates[key]; ok {
+		return template
+	}
+	template, err := loadPromptTemplate(name)
+	if err != nil {
+		fmt.Println("prompt error")
+		log.Fatal(err)
+	}
+	promptTemplates[key] = template
+	return template
+}
+
+// The template variables describing the user, available to every prompt.
+func userPromptData() map[string]any {
+	userName := getConfiguration().UserName
+	if userName == "" {
+		userName = "the user"
+	}
+	timezone := userLocation().String()
+	if timezone == "Local" {
+		timezone, _ = time.Now().Zone()
+	}
+	return map[string]any{
+		"UserName": userName,
+		"Timezone": timezone,
+		// Empty when no categories are configured, so templates can fall back to free-form ones
+		"Categories": formatCategoriesForPrompt(getConfiguration().Categories),
+	}
+}
+
+// The standard template variables for an email, with text as the email content.
+func emailPromptData(email Email, text string) map[string]any {
+	data := userPromptData()
+	data["Email"] = text
+	data["Sender"] = email.from
+	data["Date"] = email.date
+	return data
+}
+
+// Render a template section with the given variables.
+func formatPromptSection(section string, data map[string]any) (string, error) {
+	if section == "" {
+		return "", nil
+	}
+
+	variables := make([]string, 0, len(data))
+	for key := range data {
+		variables = append(variables, key)
+	}
+	prompt := prompts.NewPromptTemplate(section, variables)
+	return prompt.Format(data)
+}
+
+// Render the named prompt with the given variables, wrapped in the model's chat format.
+func renderPrompt(name string, data map[string]any) RenderedPrompt {
+	template := getPromptTemplate(name)
+
+	system, err := formatPromptSection(template.System, data)
+	if err != nil {
+		fmt.Println("prompt error")
+		log.Fatal(err)
+	}
+	user, err := formatPromptSection(template.User, data)
+	if err != nil {
+		fmt.Println("prompt error")
+		log.Fatal(err)
+	}
+
+	sender, _ := data["Sender"].(string)
+	return RenderedPrompt{
+		Name:    template.Name,
+		Version: template.Version,
+		System:  system,
+		User:    user,
+		Text:    getChatFormat().Render(system, user),
+		Sender:  usageSender(sender),
+	}
+}
+
+// The model's answer, without the prompt the inference API echoes back.
+func completionText(format ChatFormat, result string) string {
+	marker := format.ResponseMarker
+	if i := strings.LastIndex(result, marker); i != -1 {
+		return strings.TrimSpace(result[i+len(marker):])
+	}
+	return strings.TrimSpace(result)
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRedactAuditLog = "redactions.log"
+	// The secret the audit log's value hashes are keyed with, created on first use
+	redactKeyFileName = "redaction.key"
+)
+
+// Finds one kind of PII. When group is set only that submatch is masked, and
+// valid can reject matches that only look like PII.
+type piiDetector struct {
+	name  string
+	regex *regexp.Regexp
+	group int
+	valid func(string) bool
+}
+
+// The built in detectors, in the order they run. Card numbers go before phone
+// and account numbers so their digits are not masked piecemeal.
+var builtinDetectors = []piiDetector{
+	{name: "email", regex: regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)},
+	{name: "card", regex: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`), valid: luhnValid},
+	{name: "iban", regex: regexp.MustCompile(`\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]{4}){2,7}(?: ?[A-Z0-9]{1,4})?\b`)},
+	{name: "ssn", regex: regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`)},
+	{name: "phone", regex: regexp.MustCompile(`(?:\+\d{1,3}[\s.\-]?)?(?:\(\d{3}\)|\b\d{3})[\s.\-]?\d{3}[\s.\-]?\d{4}\b`)},
+	{name: "account", regex: regexp.MustCompile(`(?i)\b(?:account|acct|a/c)(?:\s*(?:no\.?|number|#))?\s*[:#]?\s*([0-9][0-9\-]{4,}[0-9])`), group: 1},
+	{name: "address", regex: regexp.MustCompile(`\b\d{1,5}(?:\s+[A-Z][a-z]+){1,3}\s+(?:Street|St|Avenue|Ave|Road|Rd|Boulevard|Blvd|Lane|Ln|Drive|Dr|Court|Ct|Way|Place|Pl|Terrace|Square|Sq)\b`)},
+}
+
+// Placeholders already in the text, which later detectors leave alone.
+var placeholderRegex = regexp.MustCompile(`\[[^\[\]\s]+_\d+\]`)
+
+// Check a card number's Luhn checksum.
+func luhnValid(number string) bool {
+	sum := 0
+	digits := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		digits++
+		double = !double
+	}
+	return digits >= 13 && sum%10 == 0
+}
+
+// The detectors enabled in the settings, with the custom patterns after the built in ones.
+func piiDetectors() ([]piiDetector, error) {
+	config := getConfiguration()
+
+	var detectors []piiDetector
+	enabled := make(map[string]bool)
+	for _, name := range config.RedactDetectors {
+		enabled[name] = true
+	}
+	for _, detector := range builtinDetectors {
+		if len(enabled) == 0 || enabled[detector.name] {
+			detectors = append(detectors, detector)
+		}
+	}
+
+	names := make([]string, 0, len(config.RedactPatterns))
+	for name := range config.RedactPatterns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		regex, err := regexp.Compile(config.RedactPatterns[name])
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %q: %v", name, err)
+		}
+		detectors = append(detectors, piiDetector{name: name, regex: regex})
+	}
+	return detectors, nil
+}
+
+// A piece of text replaced by a placeholder.
+type Redaction struct {
+	Detector    string
+	Placeholder string
+	Value       string
+}
+
+// Replaces PII with placeholders such as [EMAIL_1], using the same placeholder
+// each time a value appears so the model can still tell values apart.
+type redactor struct {
+	detectors    []piiDetector
+	placeholders map[string]string
+	counts       map[string]int
+	redactions   []Redaction
+}
+
+func newRedactor(detectors []piiDetector) *redactor {
+	return &redactor{
+		detectors:    detectors,
+		placeholders: make(map[string]string),
+		counts:       make(map[string]int),
+	}
+}
+
+func (r *redactor) placeholder(detector, value string) string {
+	key := detector + "\x00" + value
+	if placeholder, ok := r.placeholders[key]; ok {
+		return placeholder
+	}
+	r.counts[detector]++
+	placeholder := fmt.Sprintf("[%s_%d]", strings.ToUpper(detector), r.counts[detector])
+	r.placeholders[key] = placeholder
+	r.redactions = append(r.redactions, Redaction{Detector: detector, Placeholder: placeholder, Value: value})
+	return placeholder
+}
+
+func (r *redactor) redact(text string) string {
+	for _, detector := range r.detectors {
+		placeholders := placeholderRegex.FindAllStringIndex(text, -1)
+		overlapsPlaceholder := func(start, end int) bool {
+			for _, span := range placeholders {
+				if start < span[1] && span[0] < end {
+					return true
+				}
+			}
+			return false
+		}
+
+		var sb strings.Builder
+		last := 0
+		for _, match := range detector.regex.FindAllStringSubmatchIndex(text, -1) {
+			start, end := match[0], match[1]
+			if detector.group > 0 && len(match) > 2*detector.group+1 && match[2*detector.group] >= 0 {
+				start, end = match[2*detector.group], match[2*detector.group+1]
+			}
+			value := text[start:end]
+			if detector.valid != nil && !detector.valid(value) {
+				continue
+			}
+			if overlapsPlaceholder(start, end) {
+				continue
+			}
+			sb.WriteString(text[last:start])
+			sb.WriteString(r.placeholder(detector.name, value))
+			last = end
+		}
+		sb.WriteString(text[last:])
+		text = sb.String()
+	}
+	return text
+}
+
+// Put the original values back in place of the placeholders.
+func (r *redactor) restore(text string) string {
+	if len(r.redactions) == 0 {
+		return text
+	}
+	replacements := make([]string, 0, 2*len(r.redactions))
+	for _, redaction := range r.redactions {
+		replacements = append(replacements, redaction.Placeholder, redaction.Value)
+	}
+	return strings.NewReplacer(replacements...).Replace(text)
+}
+
+// An entry in the audit log. The masked value keeps only its ends and the hash is
+// keyed with a local secret, so the log itself does not hold the PII and short
+// values such as phone numbers cannot be recovered by hashing every candidate.
+type redactionAudit struct {
+	Time        string `json:"time"`
+	Prompt      string `json:"prompt"`
+	Provider    string `json:"provider"`
+	Detector    string `json:"detector"`
+	Placeholder string `json:"placeholder"`
+	Masked      string `json:"masked"`
+	Hash        string `json:"hash,omitempty"`
+}
+
+func maskValue(value string) string {
+	runes := []rune(value)
+	if len(runes) <= 4 {
+		return strings.Repeat("*", len(runes))
+	}
+	return string(runes[:2]) + strings.Repeat("*", len(runes)-4) + string(runes[len(runes)-2:])
+}
+
+var (
+	redactKey     []byte
+	redactKeyOnce sync.Once
+)
+
+// The secret for the audit log's hashes, read from redaction.key or created there.
+// Nil when it can be neither read nor created, in which case values are not hashed.
+func getRedactKey() []byte {
+	redactKeyOnce.Do(func() {
+		key, err := os.ReadFile(redactKeyFileName)
+		if err == nil && len(key) >= 32 {
+			redactKey = key
+			return
+		}
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			fmt.Println("Unable to create the redaction key: ", err)
+			return
+		}
+		if err := os.WriteFile(redactKeyFileName, key, 0600); err != nil {
+			fmt.Println("Unable to save the redaction key: ", err)
+			return
+		}
+		redactKey = key
+	})
+	return redactKey
+}
+
+var redactAuditMu sync.Mutex
+
+// Append what was masked in a prompt to the audit log, one JSON object per line.
+func writeRedactionAudit(prompt, provider string, redactions []Redaction) error {
+	if len(redactions) == 0 {
+		return nil
+	}
+	file := getConfiguration().RedactAuditLog
+	if file == "" {
+		file = defaultRedactAuditLog
+	}
+
+	promptHash := sha256.Sum256([]byte(prompt))
+	now := time.Now().Format(time.RFC3339)
+	key := getRedactKey()
+	var sb strings.Builder
+	for _, redaction := range redactions {
+		audit := redactionAudit{
+			Time:        now,
+			Prompt:      hex.EncodeToString(promptHash[:8]),
+			Provider:    provider,
+			Detector:    redaction.Detector,
+			Placeholder: redaction.Placeholder,
+			Masked:      maskValue(redaction.Value),
+		}
+		if key != nil {
+			mac := hmac.New(sha256.New, key)
+			mac.Write([]byte(redaction.Value))
+			audit.Hash = hex.EncodeToString(mac.Sum(nil)[:8])
+		}
+		line, err := json.Marshal(audit)
+		if err != nil {
+			return err
+		}
+		sb.Write(line)
+		sb.WriteString("\n")
+	}
+
+	redactAuditMu.Lock()
+	defer redactAuditMu.Unlock()
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(sb.String()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
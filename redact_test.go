@@ -0,0 +1,108 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestLuhnValid(t *testing.T) {
+	tests := []struct {
+		number string
+		want   bool
+	}{
+		{"4111111111111111", true},
+		{"4111 1111 1111 1111", true},
+		{"4111-1111-1111-1111", true},
+		{"5500 0000 0000 0004", true},
+		{"378282246310005", true},
+		{"4111111111111112", false},
+		{"1234567890123", false},
+		// Too short to be a card number, even though the checksum works out
+		{"59", false},
+		{"000000000000", false},
+	}
+	for _, tt := range tests {
+		if got := luhnValid(tt.number); got != tt.want {
+			t.Errorf("luhnValid(%q) = %v, want %v", tt.number, got, tt.want)
+		}
+	}
+}
+
+func TestRedactDetectors(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"email", "Write to john.doe+jot@example.co.uk today", "Write to [EMAIL_1] today"},
+		{"card", "Card 4111 1111 1111 1111 expires soon", "Card [CARD_1] expires soon"},
+		{"card failing luhn", "Order 4111111111111112 shipped", "Order 4111111111111112 shipped"},
+		{"iban", "IBAN DE89 3704 0044 0532 0130 00 please", "IBAN [IBAN_1] please"},
+		{"ssn", "SSN 123-45-6789.", "SSN [SSN_1]."},
+		{"phone", "Call (555) 123-4567 or +1 555.123.4567", "Call [PHONE_1] or [PHONE_2]"},
+		{"account number only", "Account no. 12345-678 is overdue", "Account no. [ACCOUNT_1] is overdue"},
+		{"address", "Meet at 221 Baker Street at noon", "Meet at [ADDRESS_1] at noon"},
+		{"repeated value", "a@b.com, c@d.com and a@b.com", "[EMAIL_1], [EMAIL_2] and [EMAIL_1]"},
+		{"nothing to mask", "See you on Friday at 10", "See you on Friday at 10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRedactor(builtinDetectors)
+			if got := r.redact(tt.text); got != tt.want {
+				t.Errorf("redact(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactOverlappingDetectors(t *testing.T) {
+	detectors := append(append([]piiDetector{}, builtinDetectors...),
+		piiDetector{name: "number", regex: regexp.MustCompile(`\d+`)})
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		// The card detector runs first, so the digits are not taken for a phone number
+		{"card before phone", "Paid with 5500 0000 0000 0004", "Paid with [CARD_1]"},
+		// Digits inside an address are masked with the address
+		{"digits in an email", "From jane.5551234567@example.com", "From [EMAIL_1]"},
+		{"ssn before phone", "SSN 123-45-6789", "SSN [SSN_1]"},
+		// A later detector does not mask the numbers in earlier placeholders
+		{"placeholders left alone", "Mail a@b.com or call 555-123-4567, ref 42", "Mail [EMAIL_1] or call [PHONE_1], ref [NUMBER_1]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRedactor(detectors)
+			if got := r.redact(tt.text); got != tt.want {
+				t.Errorf("redact(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactRestore(t *testing.T) {
+	detectors := append(append([]piiDetector{}, builtinDetectors...),
+		piiDetector{name: "employee_id", regex: regexp.MustCompile(`EMP-\d{6}`)})
+	texts := []string{
+		"Mail john.doe@example.com or call (555) 123-4567, card 4111 1111 1111 1111",
+		"SSN 123-45-6789, IBAN DE89 3704 0044 0532 0130 00, acct 98765-4321",
+		"EMP-123456 lives at 10 Downing Street and EMP-123456 is on leave",
+		"a1@x.io a2@x.io a3@x.io a4@x.io a5@x.io a6@x.io a7@x.io a8@x.io a9@x.io a10@x.io a11@x.io",
+	}
+	for _, text := range texts {
+		r := newRedactor(detectors)
+		redacted := r.redact(text)
+		if redacted == text {
+			t.Errorf("nothing masked in %q", text)
+		}
+		if got := r.restore(redacted); got != text {
+			t.Errorf("restore(%q) = %q, want %q", redacted, got, text)
+		}
+		// The model's answer quotes the placeholders in another order
+		answer := "Reply to " + redacted + " and " + r.redactions[0].Placeholder
+		if got, want := r.restore(answer), "Reply to "+text+" and "+r.redactions[0].Value; got != want {
+			t.Errorf("restore(%q) = %q, want %q", answer, got, want)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	reportDays = 7
+	// How many days before the week unchecked action items are still reported from
+	openItemsLookbackDays = 30
+)
+
+// An action item that has not been checked off in Notion.
+type OpenActionItem struct {
+	ActionItem
+	Subject string
+	URL     string
+	Overdue bool
+}
+
+// A count of emails for a sender or category.
+type ReportCount struct {
+	Name  string
+	Count int
+}
+
+type WeeklyReport struct {
+	Start      string
+	End        string
+	Emails     int
+	Senders    []ReportCount
+	Categories []ReportCount
+	Open       []OpenActionItem
+	Narrative  string
+}
+
+// The days of the week ending on end, oldest first.
+func reportWeek(end time.Time) []string {
+	days := make([]string, reportDays)
+	for i := range days {
+		days[i] = end.AddDate(0, 0, i-reportDays+1).Format("2006-01-02")
+	}
+	return days
+}
+
+// Count occurrences of each name, most frequent first.
+func sortedCounts(counts map[string]int) []ReportCount {
+	sorted := make([]ReportCount, 0, len(counts))
+	for name, count := range counts {
+		sorted = append(sorted, ReportCount{name, count})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Count != sorted[j].Count {
+			return sorted[i].Count > sorted[j].Count
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
+
+// The action items of a row that are still unchecked, read from its to-do blocks.
+func uncheckedActionItems(integrationSecret string, row EmailRow) ([]ActionItem, error) {
+	blocks, err := readBlockChildren(integrationSecret, row.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []ActionItem
+	for _, block := range blocks {
+		if block.Type != "to_do" || block.ToDo == nil || block.ToDo.Checked {
+			continue
+		}
+		var text strings.Builder
+		for _, richText := range block.ToDo.Text {
+			text.WriteString(richText.PlainText)
+		}
+		items = append(items, parseActionItemsText(text.String())...)
+	}
+	return items, nil
+}
+
+// Gather the rows of the week's databases into a report, without the narrative.
+// Open action items also come from the weeks before, and are overdue when their
+// due date is before the end of the week.
+func buildWeeklyReport(integrationSecret string, end time.Time) (WeeklyReport, error) {
+	days := reportWeek(end)
+	report := WeeklyReport{Start: days[0], End: days[len(days)-1]}
+
+	dbInfoList, err := readDatabaseInfo("")
+	if err != nil {
+		return report, fmt.Errorf("error reading database info: %v", err)
+	}
+
+	addOpenItems := func(row EmailRow) {
+		items, err := uncheckedActionItems(integrationSecret, row)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading action items of %q: %v\n", row.Subject, err)
+			return
+		}
+		for _, item := range items {
+			report.Open = append(report.Open, OpenActionItem{
+				ActionItem: item,
+				Subject:    row.Subject,
+				URL:        row.URL,
+				Overdue:    item.Due != "" && item.Due < report.End,
+			})
+		}
+	}
+
+	// Earlier emails whose action items may still be open, oldest first
+	withActionItems := map[string]any{"property": "Has Action Items", "checkbox": map[string]any{"equals": true}}
+	for i := openItemsLookbackDays + reportDays - 1; i >= reportDays; i-- {
+		day := end.AddDate(0, 0, -i).Format("2006-01-02")
+		dbID, ok := findDatabaseID(dbInfoList, day+"-Database")
+		if !ok {
+			continue
+		}
+		rows, err := readEmailRows(integrationSecret, dbID, withActionItems)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading open action items of %s: %v\n", day, err)
+			continue
+		}
+		for _, row := range rows {
+			addOpenItems(row)
+		}
+	}
+
+	senders := make(map[string]int)
+	categories := make(map[string]int)
+	for _, day := range days {
+		dbID, ok := findDatabaseID(dbInfoList, day+"-Database")
+		if !ok {
+			continue
+		}
+		rows, err := readEmailRows(integrationSecret, dbID, nil)
+		if err != nil {
+			return report, fmt.Errorf("error reading %s: %v", day, err)
+		}
+
+		for _, row := range rows {
+			report.Emails++
+			sender := row.SenderEmail
+			if sender == "" {
+				sender = row.From
+			}
+			senders[sender]++
+			if len(row.Categories) == 0 {
+				categories[uncategorizedCategory]++
+			}
+			for _, category := range row.Categories {
+				categories[category]++
+			}
+			addOpenItems(row)
+		}
+	}
+
+	report.Senders = sortedCounts(senders)
+	report.Categories = sortedCounts(categories)
+	sort.SliceStable(report.Open, func(i, j int) bool {
+		a, b := report.Open[i], report.Open[j]
+		if a.Overdue != b.Overdue {
+			return a.Overdue
+		}
+		if (a.Due == "") != (b.Due == "") {
+			return b.Due == ""
+		}
+		return a.Due < b.Due
+	})
+	return report, nil
+}
+
+func formatCounts(counts []ReportCount, limit int) string {
+	var lines []string
+	for i, count := range counts {
+		if i == limit {
+			lines = append(lines, fmt.Sprintf("- %d others", len(counts)-limit))
+			break
+		}
+		lines = append(lines, fmt.Sprintf("- %s: %d", count.Name, count.Count))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func formatOpenActionItem(item OpenActionItem) string {
+	text := item.Task
+	if item.Due != "" {
+		text += " (due " + item.Due + ")"
+	}
+	return text
+}
+
+// The report's numbers and open items as text for the report prompt.
+func formatReportForPrompt(report WeeklyReport) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Emails received: %d\n\nTop senders:\n%s\n\nCategories:\n%s\n\nOpen action items:\n",
+		report.Emails, formatCounts(report.Senders, 10), formatCounts(report.Categories, 20))
+	for _, item := range report.Open {
+		sb.WriteString("- " + formatOpenActionItem(item) + " from \"" + item.Subject + "\"")
+		if item.Overdue {
+			sb.WriteString(" OVERDUE")
+		}
+		sb.WriteString("\n")
+	}
+
+	text := strings.TrimSpace(sb.String())
+	chunkTokens, _, _ := chunkSettings()
+	if countTokens(text) > chunkTokens {
+		text = splitByTokens(text, chunkTokens)[0]
+	}
+	return text
+}
+
+func generateReportPrompt(report WeeklyReport) RenderedPrompt {
+	data := userPromptData()
+	data["Start"] = report.Start
+	data["End"] = report.End
+	data["Report"] = formatReportForPrompt(report)
+	return renderPrompt("weekly_report", data)
+}
+
+func (r WeeklyReport) title() string {
+	return fmt.Sprintf("Weekly Report %s to %s", r.Start, r.End)
+}
+
+// The open action items that are, or are not, past their due date.
+func (r WeeklyReport) openItems(overdue bool) []OpenActionItem {
+	var items []OpenActionItem
+	for _, item := range r.Open {
+		if item.Overdue == overdue {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (r WeeklyReport) markdown() string {
+	var sb strings.Builder
+	sb.WriteString("# " + r.title() + "\n\n")
+	sb.WriteString(strings.TrimSpace(r.Narrative) + "\n\n")
+
+	fmt.Fprintf(&sb, "## Emails\n\n%d emails received.\n\n### Senders\n\n%s\n\n### Categories\n\n%s\n\n",
+		r.Emails, formatCounts(r.Senders, len(r.Senders)), formatCounts(r.Categories, len(r.Categories)))
+
+	writeItems := func(heading string, items []OpenActionItem) {
+		sb.WriteString("## " + heading + "\n\n")
+		if len(items) == 0 {
+			sb.WriteString("None\n\n")
+			return
+		}
+		for _, item := range items {
+			subject := item.Subject
+			if item.URL != "" {
+				subject = "[" + subject + "](" + item.URL + ")"
+			}
+			sb.WriteString("- [ ] " + formatOpenActionItem(item) + " - " + subject + "\n")
+		}
+		sb.WriteString("\n")
+	}
+	writeItems("Overdue", r.openItems(true))
+	writeItems("Open Action Items", r.openItems(false))
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+func (r WeeklyReport) blocks() []Block {
+	blocks := []Block{headingBlock(2, "Overview")}
+	for _, paragraph := range strings.Split(r.Narrative, "\n\n") {
+		if paragraph = strings.TrimSpace(paragraph); paragraph != "" {
+			blocks = append(blocks, paragraphBlock(plainRichText(paragraph)))
+		}
+	}
+
+	blocks = append(blocks, headingBlock(2, "Emails"),
+		paragraphBlock(plainRichText(fmt.Sprintf("%d emails received.", r.Emails))),
+		headingBlock(3, "Senders"))
+	for _, sender := range r.Senders {
+		blocks = append(blocks, bulletBlock(plainRichText(fmt.Sprintf("%s: %d", sender.Name, sender.Count))))
+	}
+	blocks = append(blocks, headingBlock(3, "Categories"))
+	for _, category := range r.Categories {
+		blocks = append(blocks, bulletBlock(plainRichText(fmt.Sprintf("%s: %d", category.Name, category.Count))))
+	}
+
+	addItems := func(heading string, items []OpenActionItem) {
+		blocks = append(blocks, headingBlock(2, heading))
+		if len(items) == 0 {
+			blocks = append(blocks, paragraphBlock(plainRichText("None")))
+		}
+		for _, item := range items {
+			blocks = append(blocks, Block{
+				Object: "block",
+				Type:   "to_do",
+				ToDo:   &TextBlock{Text: append(plainRichText(formatOpenActionItem(item)+" - "), linkText(item.Subject, item.URL))},
+			})
+		}
+	}
+	addItems("Overdue", r.openItems(true))
+	addItems("Open Action Items", r.openItems(false))
+	return blocks
+}
+
+// Build the weekly report ending on end and either publish it under the parent
+// page or, when markdownFile is set, write it there.
+func writeWeeklyReport(config Config, end time.Time, markdownFile string) error {
+	report, err := buildWeeklyReport(config.IntegrationSecret, end)
+	if err != nil {
+		return err
+	}
+
+	report.Narrative = "No email was processed this week."
+	if report.Emails > 0 {
+		prompt := generateReportPrompt(report)
+		if report.Narrative, _, err = callLLM(prompt); err != nil {
+			return fmt.Errorf("error writing the report narrative: %v", err)
+		}
+	}
+
+	if markdownFile != "" {
+		if err := os.WriteFile(markdownFile, []byte(report.markdown()+"\n"), 0644); err != nil {
+			return fmt.Errorf("error writing report: %v", err)
+		}
+		fmt.Printf("Report written to %s\n", markdownFile)
+		return nil
+	}
+
+	page, err := createChildPage(config.IntegrationSecret, config.ParentPageID, report.title(), report.blocks())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Report written to %s\n", page.URL)
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// The subset of JSON Schema used to validate LLM output: type, enum, required,
+// properties, additionalProperties, items, minItems, minLength and pattern.
+type JSONSchema struct {
+	Type                 any                    `json:"type"`
+	Enum                 []any                  `json:"enum"`
+	Required             []string               `json:"required"`
+	Properties           map[string]*JSONSchema `json:"properties"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Items                *JSONSchema            `json:"items"`
+	MinItems             *int                   `json:"minItems"`
+	MinLength            *int                   `json:"minLength"`
+	Pattern              string                 `json:"pattern"`
+}
+
+// Load a schema from ./prompts, falling back to the copy built into the binary.
+func loadJSONSchema(name string) (*JSONSchema, error) {
+	file := promptsDirName + "/" + name
+	data, err := os.ReadFile(file)
+	if err != nil {
+		data, err = defaultPrompts.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read schema %s: %v", file, err)
+		}
+	}
+
+	var schema JSONSchema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, fmt.Errorf("unable to parse schema %s: %v", file, err)
+	}
+	return &schema, nil
+}
+
+// The JSON type name of a decoded value.
+func jsonType(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == float64(int64(v)) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return "unknown"
+}
+
+func (s *JSONSchema) allowsType(actual string) bool {
+	var allowed []string
+	switch t := s.Type.(type) {
+	case nil:
+		return true
+	case string:
+		allowed = []string{t}
+	case []any:
+		for _, name := range t {
+			if str, ok := name.(string); ok {
+				allowed = append(allowed, str)
+			}
+		}
+	}
+
+	for _, name := range allowed {
+		if name == actual || (name == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate a value decoded from JSON against the schema, returning every problem found.
+func (s *JSONSchema) Validate(value any) []string {
+	return s.validate("$", value)
+}
+
+func (s *JSONSchema) validate(path string, value any) []string {
+	var problems []string
+
+	actual := jsonType(value)
+	if !s.allowsType(actual) {
+		return []string{fmt.Sprintf("%s: expected %v, got %s", path, s.Type, actual)}
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		for _, option := range s.Enum {
+			if fmt.Sprint(option) == fmt.Sprint(value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("%s: %v is not one of %v", path, value, s.Enum))
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		if s.MinLength != nil && utf8.RuneCountInString(v) < *s.MinLength {
+			problems = append(problems, fmt.Sprintf("%s: shorter than %d characters", path, *s.MinLength))
+		}
+		if s.Pattern != "" {
+			re, err := regexp.Compile(s.Pattern)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: invalid pattern %q in schema", path, s.Pattern))
+			} else if !re.MatchString(v) {
+				problems = append(problems, fmt.Sprintf("%s: %q does not match %s", path, v, s.Pattern))
+			}
+		}
+	case []any:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			problems = append(problems, fmt.Sprintf("%s: fewer than %d items", path, *s.MinItems))
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				problems = append(problems, s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item)...)
+			}
+		}
+	case map[string]any:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				problems = append(problems, fmt.Sprintf("%s: missing required property %q", path, name))
+			}
+		}
+
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			property, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					problems = append(problems, fmt.Sprintf("%s: unexpected property %q", path, name))
+				}
+				continue
+			}
+			problems = append(problems, property.validate(path+"."+name, v[name])...)
+		}
+	}
+
+	return problems
+}
+
+// Pull the JSON object out of a completion, which models often wrap in prose or code fences.
+func extractJSONObject(text string) (string, error) {
+	start := strings.Index(text, "{")
+	end := strings.LastIndex(text, "}")
+	if start == -1 || end < start {
+		return "", fmt.Errorf("no JSON object in response")
+	}
+	return text[start : end+1], nil
+}
+
+// Decode the JSON object in a completion into target after validating it against the schema.
+func decodeValidated(text string, schema *JSONSchema, target any) error {
+	object, err := extractJSONObject(text)
+	if err != nil {
+		return err
+	}
+
+	var value any
+	if err := json.Unmarshal([]byte(object), &value); err != nil {
+		return fmt.Errorf("invalid JSON: %v", err)
+	}
+	if problems := schema.Validate(value); len(problems) > 0 {
+		return fmt.Errorf("response does not match the schema: %s", strings.Join(problems, "; "))
+	}
+	return json.Unmarshal([]byte(object), target)
+}
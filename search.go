@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/tmc/langchaingo/embeddings"
+	hfembeddings "github.com/tmc/langchaingo/embeddings/huggingface"
+	"github.com/tmc/langchaingo/llms/huggingface"
+	"github.com/tmc/langchaingo/llms/ollama"
+	"github.com/tmc/langchaingo/llms/openai"
+)
+
+const (
+	searchIndexFileName = "searchIndex.json"
+
+	defaultHuggingFaceEmbeddingModel = "sentence-transformers/all-mpnet-base-v2"
+	defaultOpenAIEmbeddingModel      = "text-embedding-ada-002"
+	defaultOllamaEmbeddingModel      = "nomic-embed-text"
+
+	// Dimensions of the vectors made by the local stand-in
+	localEmbeddingSize = 512
+)
+
+// An email in the search index, with the vectors of its text and of its summary.
+type IndexEntry struct {
+	ID            string    `json:"id"`
+	ThreadID      string    `json:"threadId,omitempty"`
+	Date          string    `json:"date"`
+	From          string    `json:"from"`
+	SenderEmail   string    `json:"senderEmail,omitempty"`
+	Subject       string    `json:"subject"`
+	Summary       string    `json:"summary"`
+	Text          string    `json:"text"`
+	Categories    []string  `json:"categories,omitempty"`
+	ActionItems   []string  `json:"actionItems,omitempty"`
+	Link          string    `json:"link,omitempty"`
+	NotionURL     string    `json:"notionUrl,omitempty"`
+	Embedder      string    `json:"embedder"`
+	TextVector    []float32 `json:"textVector"`
+	SummaryVector []float32 `json:"summaryVector"`
+}
+
+// A search result and how similar it is to the query.
+type SearchResult struct {
+	Entry IndexEntry
+	Score float64
+}
+
+// The embedding provider and model, following the LLM provider unless set explicitly.
+func embeddingSettings() (string, string) {
+	config := getConfiguration()
+	provider := config.EmbeddingProvider
+	if provider == "" {
+		provider = providerName()
+	}
+	model := config.EmbeddingModel
+	if model == "" {
+		switch provider {
+		case providerHuggingFace:
+			model = defaultHuggingFaceEmbeddingModel
+		case providerOpenAI:
+			model = defaultOpenAIEmbeddingModel
+		case providerOllama:
+			model = defaultOllamaEmbeddingModel
+		}
+	}
+	return provider, model
+}
+
+// Identifies the vectors of one provider and model, which cannot be compared with others.
+func embedderName() string {
+	provider, model := embeddingSettings()
+	if model == "" {
+		return provider
+	}
+	return provider + "/" + model
+}
+
+func newEmbedder(provider, model string) (embeddings.Embedder, error) {
+	switch provider {
+	case providerHuggingFace:
+		client, err := huggingface.New(huggingface.WithToken(os.Getenv("HUGGINGFACEHUB_API_TOKEN")))
+		if err != nil {
+			return nil, err
+		}
+		return hfembeddings.NewHuggingface(hfembeddings.WithClient(*client), hfembeddings.WithModel(model))
+	case providerOllama:
+		options := []ollama.Option{ollama.WithModel(model)}
+		if url := getConfiguration().OllamaURL; url != "" {
+			options = append(options, ollama.WithServerURL(url))
+		}
+		client, err := ollama.New(options...)
+		if err != nil {
+			return nil, err
+		}
+		return embeddings.NewEmbedder(client)
+	case providerOpenAI:
+		client, err := openai.New(openai.WithEmbeddingModel(model))
+		if err != nil {
+			return nil, err
+		}
+		return embeddings.NewEmbedder(client)
+	case providerLocal:
+		return localEmbedder{}, nil
+	}
+	return nil, fmt.Errorf("unknown embedding provider %q, expected huggingface, ollama, openai or local", provider)
+}
+
+var (
+	embedders   = make(map[string]embeddings.Embedder)
+	embeddersMu sync.Mutex
+)
+
+func resetEmbedders() {
+	embeddersMu.Lock()
+	embedders = make(map[string]embeddings.Embedder)
+	embeddersMu.Unlock()
+}
+
+func getEmbedder() (embeddings.Embedder, error) {
+	embeddersMu.Lock()
+	defer embeddersMu.Unlock()
+
+	name := embedderName()
+	if embedder, ok := embedders[name]; ok {
+		return embedder, nil
+	}
+	embedder, err := newEmbedder(embeddingSettings())
+	if err != nil {
+		return nil, err
+	}
+	embedders[name] = embedder
+	return embedder, nil
+}
+
+// Embed a text with the configured provider, within its rate limits. When
+// redaction is on, PII in email text is masked before it is sent to a remote
+// provider. Queries are the user's own words and are embedded as typed.
+func embedText(text string, query bool) ([]float32, error) {
+	embedder, err := getEmbedder()
+	if err != nil {
+		return nil, err
+	}
+
+	provider, _ := embeddingSettings()
+	if getConfiguration().Redact && !query && provider != providerLocal {
+		detectors, err := piiDetectors()
+		if err != nil {
+			return nil, err
+		}
+		pii := newRedactor(detectors)
+		text = pii.redact(text)
+		if err := writeRedactionAudit(text, provider, pii.redactions); err != nil {
+			fmt.Println("Unable to write the redaction audit log: ", err)
+		}
+	}
+	if provider != providerLocal {
+		limiter := getRateLimiter(provider)
+		limiter.acquire()
+		defer limiter.release()
+	}
+
+	// EmbedQuery rather than EmbedDocuments, which the HuggingFace embedder
+	// combines into a single vector per batch
+	start := time.Now()
+	vector, err := embedder.EmbedQuery(context.Background(), text)
+	if err != nil {
+		return nil, err
+	}
+	_, model := embeddingSettings()
+	recordUsage(UsageCall{Provider: provider, Model: model, PromptTokens: countTokens(text), Latency: time.Since(start)})
+	return vector, nil
+}
+
+// A deterministic stand-in for an embedding model that hashes words and word
+// pairs into a fixed number of dimensions, so texts sharing words end up close.
+type localEmbedder struct{}
+
+func (localEmbedder) EmbedQuery(ctx context.Context, text string) ([]float32, error) {
+	vector := make([]float32, localEmbeddingSize)
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	add := func(feature string, weight float32) {
+		h := fnv.New32a()
+		h.Write([]byte(feature))
+		vector[h.Sum32()%localEmbeddingSize] += weight
+	}
+	for i, word := range words {
+		add(word, 1)
+		if i > 0 {
+			add(words[i-1]+" "+word, 0.5)
+		}
+	}
+	return vector, nil
+}
+
+func (e localEmbedder) EmbedDocuments(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		vector, err := e.EmbedQuery(ctx, text)
+		if err != nil {
+			return nil, err
+		}
+		vectors[i] = vector
+	}
+	return vectors, nil
+}
+
+func cosineSimilarity(a, b []float32) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+// The text an email is indexed and searched by: its headers and the start of its body.
+func indexText(email Email) string {
+	return firstChunk(formatEmailHeader(email), email.body)
+}
+
+// Compute the vectors of an email's text and summary for the search index.
+func embedEmail(email Email) (IndexEntry, error) {
+	entry := IndexEntry{
+		ID:         email.id,
+		ThreadID:   email.threadID,
+		Date:       email.date,
+		From:       email.from,
+		Subject:    email.subject,
+		Summary:    email.summary,
+		Text:       indexText(email),
+		Categories: email.categories,
+		Link:       messageLink(email),
+		Embedder:   embedderName(),
+	}
+	if entry.ID == "" {
+		entry.ID = email.messageID
+	}
+	if email.sender != nil {
+		entry.SenderEmail = email.sender.Address
+	}
+	for _, item := range email.actionItems {
+		entry.ActionItems = append(entry.ActionItems, item.Task)
+	}
+
+	var err error
+	if entry.TextVector, err = embedText(entry.Text, false); err != nil {
+		return entry, fmt.Errorf("unable to embed email text: %v", err)
+	}
+	if entry.Summary != "" {
+		if entry.SummaryVector, err = embedText(entry.Subject+"\n"+entry.Summary, false); err != nil {
+			return entry, fmt.Errorf("unable to embed summary: %v", err)
+		}
+	}
+	return entry, nil
+}
+
+// The local vector index, kept in searchIndex.json.
+type SearchIndex struct {
+	mu      sync.Mutex
+	Entries []IndexEntry `json:"entries"`
+}
+
+func readSearchIndex() (*SearchIndex, error) {
+	index := &SearchIndex{}
+	data, err := os.ReadFile(searchIndexFileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return index, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", searchIndexFileName, err)
+	}
+	return index, nil
+}
+
+// Add an entry, replacing an earlier one for the same email.
+func (index *SearchIndex) add(entry IndexEntry) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	for i := range index.Entries {
+		if index.Entries[i].ID == entry.ID {
+			index.Entries[i] = entry
+			return
+		}
+	}
+	index.Entries = append(index.Entries, entry)
+}
+
+func (index *SearchIndex) save() error {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	tmp := searchIndexFileName + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, searchIndexFileName)
+}
+
+// Rank the entries that pass keep by how similar their text or summary is to
+// the query vector, best first. Entries made by another embedder are skipped.
+func (index *SearchIndex) search(query []float32, limit int, keep func(IndexEntry) bool) ([]SearchResult, int) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	name := embedderName()
+	skipped := 0
+	var results []SearchResult
+	for _, entry := range index.Entries {
+		if entry.Embedder != name {
+			skipped++
+			continue
+		}
+		if keep != nil && !keep(entry) {
+			continue
+		}
+		score := max(cosineSimilarity(query, entry.TextVector), cosineSimilarity(query, entry.SummaryVector))
+		results = append(results, SearchResult{entry, score})
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, skipped
+}
+
+func searchEmails(query string, limit int) {
+	index, err := readSearchIndex()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(index.Entries) == 0 {
+		fmt.Println("The search index is empty. Set searchIndex in settings.json and run jot to add emails to it.")
+		return
+	}
+
+	vector, err := embedText(query, true)
+	if err != nil {
+		log.Fatalf("Unable to embed the query: %v", err)
+	}
+	results, skipped := index.search(vector, limit, nil)
+	if skipped > 0 {
+		fmt.Printf("Skipped %d emails indexed with another embedding model\n\n", skipped)
+	}
+
+	for i, result := range results {
+		fmt.Printf("%d. %.3f  %s  %s\n   %s\n", i+1, result.Score, result.Entry.Date, result.Entry.From, result.Entry.Subject)
+		if result.Entry.Summary != "" {
+			fmt.Printf("   %s\n", result.Entry.Summary)
+		}
+		if result.Entry.Link != "" {
+			fmt.Printf("   Gmail:  %s\n", result.Entry.Link)
+		}
+		if result.Entry.NotionURL != "" {
+			fmt.Printf("   Notion: %s\n", result.Entry.NotionURL)
+		}
+	}
+}
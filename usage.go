@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	usageFileName = "usage.json"
+	// How often the totals are written during a run, they are written at the end too
+	usageSaveInterval = 30 * time.Second
+	// How long the totals of each run and sender are kept
+	usageRetention = 90 * 24 * time.Hour
+)
+
+// Dollars per million prompt and completion tokens.
+type ModelPrice struct {
+	Prompt     float64 `json:"prompt"`
+	Completion float64 `json:"completion"`
+}
+
+// One model or embedding call.
+type UsageCall struct {
+	Provider         string
+	Model            string
+	Sender           string
+	PromptTokens     int
+	CompletionTokens int
+	Latency          time.Duration
+}
+
+type UsageTotals struct {
+	Calls            int     `json:"calls"`
+	PromptTokens     int     `json:"promptTokens"`
+	CompletionTokens int     `json:"completionTokens"`
+	LatencyMs        int64   `json:"latencyMs"`
+	Cost             float64 `json:"cost"`
+	// The day of the latest call, for pruning
+	LastUsed string `json:"lastUsed,omitempty"`
+}
+
+func (t *UsageTotals) add(call UsageCall, cost float64) {
+	t.Calls++
+	t.PromptTokens += call.PromptTokens
+	t.CompletionTokens += call.CompletionTokens
+	t.LatencyMs += call.Latency.Milliseconds()
+	t.Cost += cost
+}
+
+func (t UsageTotals) averageLatency() time.Duration {
+	if t.Calls == 0 {
+		return 0
+	}
+	return time.Duration(t.LatencyMs/int64(t.Calls)) * time.Millisecond
+}
+
+// Token and cost totals per run, day, sender and model, kept in usage.json.
+type UsageStore struct {
+	mu sync.Mutex
+	// Calls recorded since the totals were last written, and when that was
+	dirty    bool
+	lastSave time.Time
+
+	Runs    map[string]*UsageTotals `json:"runs"`
+	Days    map[string]*UsageTotals `json:"days"`
+	Senders map[string]*UsageTotals `json:"senders"`
+	Models  map[string]*UsageTotals `json:"models"`
+}
+
+func newUsageStore() *UsageStore {
+	return &UsageStore{
+		Runs:    make(map[string]*UsageTotals),
+		Days:    make(map[string]*UsageTotals),
+		Senders: make(map[string]*UsageTotals),
+		Models:  make(map[string]*UsageTotals),
+	}
+}
+
+func readUsageStore() (*UsageStore, error) {
+	store := newUsageStore()
+	data, err := os.ReadFile(usageFileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, store); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", usageFileName, err)
+	}
+	return store, nil
+}
+
+// Callers hold store.mu.
+func (store *UsageStore) save() error {
+	data, err := json.MarshalIndent(store, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := usageFileName + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, usageFileName); err != nil {
+		return err
+	}
+	store.dirty = false
+	store.lastSave = time.Now()
+	return nil
+}
+
+// Drop the totals of runs and senders older than the retention period. Callers
+// hold store.mu.
+func (store *UsageStore) prune(now time.Time) {
+	cutoff := now.Add(-usageRetention)
+	for run := range store.Runs {
+		if started, err := time.ParseInLocation("2006-01-02T15:04:05", run, time.Local); err == nil && started.Before(cutoff) {
+			delete(store.Runs, run)
+		}
+	}
+	cutoffDay := cutoff.In(userLocation()).Format("2006-01-02")
+	for sender, totals := range store.Senders {
+		if totals.LastUsed < cutoffDay {
+			delete(store.Senders, sender)
+		}
+	}
+}
+
+var (
+	usageStore     *UsageStore
+	usageStoreOnce sync.Once
+
+	// Identifies this run in the usage totals
+	usageRun = time.Now().Format("2006-01-02T15:04:05")
+)
+
+func getUsageStore() *UsageStore {
+	usageStoreOnce.Do(func() {
+		store, err := readUsageStore()
+		if err != nil {
+			fmt.Println("Unable to read usage totals, starting over: ", err)
+			store = newUsageStore()
+		}
+		store.lastSave = time.Now()
+		usageStore = store
+	})
+	return usageStore
+}
+
+// The price of a model from the settings, looked up by provider/model, then
+// model, then provider. Unpriced models cost nothing.
+func modelPrice(provider, model string) ModelPrice {
+	prices := getConfiguration().Prices
+	for _, key := range []string{provider + "/" + model, model, provider} {
+		if price, ok := prices[key]; ok {
+			return price
+		}
+	}
+	return ModelPrice{}
+}
+
+func (call UsageCall) cost() float64 {
+	price := modelPrice(call.Provider, call.Model)
+	return (float64(call.PromptTokens)*price.Prompt + float64(call.CompletionTokens)*price.Completion) / 1e6
+}
+
+// The lowercase address of a sender as shown in prompts, "" when it has none.
+func usageSender(from string) string {
+	if from == "" {
+		return ""
+	}
+	if address := parseAddress(from); address != nil {
+		return strings.ToLower(address.Address)
+	}
+	return strings.ToLower(from)
+}
+
+// Add a call to the totals of this run, today, its sender and its model. The
+// totals are written every usageSaveInterval and by saveUsage at the end of a run.
+func recordUsage(call UsageCall) {
+	store := getUsageStore()
+	cost := call.cost()
+	today := time.Now().In(userLocation()).Format("2006-01-02")
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	add := func(totals map[string]*UsageTotals, key string) {
+		if totals[key] == nil {
+			totals[key] = &UsageTotals{}
+		}
+		totals[key].add(call, cost)
+		totals[key].LastUsed = today
+	}
+	add(store.Runs, usageRun)
+	add(store.Days, today)
+	add(store.Models, call.Provider+"/"+call.Model)
+	if call.Sender != "" {
+		add(store.Senders, call.Sender)
+	}
+	store.dirty = true
+	if time.Since(store.lastSave) >= usageSaveInterval {
+		if err := store.save(); err != nil {
+			fmt.Println("Unable to save usage totals: ", err)
+		}
+	}
+}
+
+// Prune and write the totals if any call was recorded since they were last written.
+func saveUsage() error {
+	store := getUsageStore()
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if !store.dirty {
+		return nil
+	}
+	store.prune(time.Now())
+	return store.save()
+}
+
+// A token count reported by the provider, if it reported one.
+func generationTokens(info map[string]any, key string) (int, bool) {
+	switch n := info[key].(type) {
+	case int:
+		return n, true
+	case int64:
+		return int(n), true
+	case float64:
+		return int(n), true
+	}
+	return 0, false
+}
+
+// Today's spend so far.
+func spentToday() float64 {
+	store := getUsageStore()
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if totals := store.Days[time.Now().In(userLocation()).Format("2006-01-02")]; totals != nil {
+		return totals.Cost
+	}
+	return 0
+}
+
+var budgetNoticeOnce sync.Once
+
+// Whether today's spend has reached the daily budget, if one is set.
+func overBudget() bool {
+	budget := getConfiguration().DailyBudget
+	if budget <= 0 {
+		return false
+	}
+	spent := spentToday()
+	if spent < budget {
+		return false
+	}
+	budgetNoticeOnce.Do(func() {
+		fmt.Printf("Spent $%.4f of the $%.2f daily budget, leaving the remaining emails for the next run\n", spent, budget)
+	})
+	return true
+}
+
+var (
+	pausedMessages   []string
+	pausedMessagesMu sync.Mutex
+)
+
+// Leave an email for the next run because the budget was reached.
+func pauseMessage(id string) {
+	pausedMessagesMu.Lock()
+	pausedMessages = append(pausedMessages, id)
+	pausedMessagesMu.Unlock()
+}
+
+// Add the emails left over the budget to the failed messages so the next run
+// fetches them again.
+func deferPausedMessages() error {
+	pausedMessagesMu.Lock()
+	defer pausedMessagesMu.Unlock()
+	if len(pausedMessages) == 0 {
+		return nil
+	}
+	failed, err := readFailedMessages()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d emails left for the next run\n", len(pausedMessages))
+	return saveFailedMessages(mergeMessageIDs(pausedMessages, failed))
+}
+
+func formatUsageTotals(t UsageTotals) string {
+	return fmt.Sprintf("%5d calls  %9d prompt  %8d completion tokens  $%9.4f  avg %v",
+		t.Calls, t.PromptTokens, t.CompletionTokens, t.Cost, t.averageLatency().Round(10*time.Millisecond))
+}
+
+// Print today's spend against the budget, the last run, the totals of recent
+// days and per model, and the senders that cost the most.
+func printUsageReport(days, senders int) {
+	store, err := readUsageStore()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	if len(store.Days) == 0 {
+		fmt.Println("No usage recorded yet.")
+		return
+	}
+
+	today := time.Now().In(userLocation()).Format("2006-01-02")
+	todayTotals := UsageTotals{}
+	if totals := store.Days[today]; totals != nil {
+		todayTotals = *totals
+	}
+	fmt.Printf("Today %s: %d calls, $%.4f", today, todayTotals.Calls, todayTotals.Cost)
+	if budget := getConfiguration().DailyBudget; budget > 0 {
+		fmt.Printf(" of the $%.2f daily budget", budget)
+	}
+	fmt.Println()
+
+	runs := sortedKeys(store.Runs)
+	if len(runs) > 0 {
+		last := runs[len(runs)-1]
+		fmt.Printf("Last run %s: %s\n", last, formatUsageTotals(*store.Runs[last]))
+	}
+
+	fmt.Println("\nBy day:")
+	dayKeys := sortedKeys(store.Days)
+	if len(dayKeys) > days {
+		dayKeys = dayKeys[len(dayKeys)-days:]
+	}
+	for _, day := range dayKeys {
+		fmt.Printf("  %s  %s\n", day, formatUsageTotals(*store.Days[day]))
+	}
+
+	fmt.Println("\nBy model:")
+	for _, model := range sortedKeys(store.Models) {
+		fmt.Printf("  %-50s %s\n", model, formatUsageTotals(*store.Models[model]))
+	}
+
+	senderKeys := sortedKeys(store.Senders)
+	sort.SliceStable(senderKeys, func(i, j int) bool {
+		a, b := store.Senders[senderKeys[i]], store.Senders[senderKeys[j]]
+		if a.Cost != b.Cost {
+			return a.Cost > b.Cost
+		}
+		return a.PromptTokens+a.CompletionTokens > b.PromptTokens+b.CompletionTokens
+	})
+	if len(senderKeys) > senders {
+		senderKeys = senderKeys[:senders]
+	}
+	if len(senderKeys) > 0 {
+		fmt.Println("\nTop senders:")
+		for _, sender := range senderKeys {
+			fmt.Printf("  %-40s %s\n", sender, formatUsageTotals(*store.Senders[sender]))
+		}
+	}
+}
+
+func sortedKeys(totals map[string]*UsageTotals) []string {
+	keys := make([]string, 0, len(totals))
+	for key := range totals {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}